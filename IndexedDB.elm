@@ -7,6 +7,7 @@ port module IndexedDB exposing
     , Query(..)
     , createObjectStore
     , createObjectStoreResult
+    , delete
     , get
     , getResult
     , openRequest
@@ -79,6 +80,22 @@ put os key data =
         |> putInternal
 
 
+port deleteInternal : JE.Value -> Cmd msg
+
+
+{-| Removes the value of key from the store. The result comes as a putResult,
+a delete being a write as well.
+-}
+delete : ObjectStore -> String -> Cmd msg
+delete os key =
+    JE.object
+        [ ( "db", JE.string os.db )
+        , ( "name", JE.string os.name )
+        , ( "key", JE.string key )
+        ]
+        |> deleteInternal
+
+
 port getInternal : JE.Value -> Cmd msg
 
 
@@ -26,7 +26,7 @@ type alias Model =
 
 
 type alias LoginForm =
-    String
+    W.Credentials
 
 
 type Msg
@@ -38,7 +38,9 @@ type Msg
     | Subscribe String
     | RequestPermission
     | ChangedName String
+    | ChangedPassword String
     | Login
+    | Register
     | Logout
 
 
@@ -80,13 +82,23 @@ viewLogin form =
         [ Html.form [ HE.onSubmit Login ]
             [ Html.fieldset []
                 [ Html.input
-                    [ HA.value form
+                    [ HA.value form.name
                     , HE.onInput ChangedName
                     , HA.placeholder "username"
                     ]
                     []
+                , Html.input
+                    [ HA.value form.password
+                    , HE.onInput ChangedPassword
+                    , HA.type_ "password"
+                    , HA.placeholder "password"
+                    ]
+                    []
                 ]
             , Html.button [] [ text "log in" ]
+            , Html.button
+                [ HA.type_ "button", HE.onClick Register ]
+                [ text "register" ]
             ]
         ]
 
@@ -252,7 +264,7 @@ init _ =
       , swSubscription = Nothing
       , swVapidKey = Nothing
       , permissionStatus = Nothing
-      , loginForm = ""
+      , loginForm = { name = "", password = "" }
       , login = Nothing
       , swErrors = []
       }
@@ -275,6 +287,12 @@ submitLogin form =
         |> W.sendMessage
 
 
+submitRegister : LoginForm -> Cmd msg
+submitRegister form =
+    W.Register form
+        |> W.sendMessage
+
+
 submitPost : String -> Cmd msg
 submitPost text =
     W.SubmitPost text |> W.sendMessage
@@ -290,11 +308,25 @@ update msg model =
             ( { model | text = newText }, Cmd.none )
 
         ChangedName name ->
-            ( { model | loginForm = name }, Cmd.none )
+            let
+                form =
+                    model.loginForm
+            in
+            ( { model | loginForm = { form | name = name } }, Cmd.none )
+
+        ChangedPassword password ->
+            let
+                form =
+                    model.loginForm
+            in
+            ( { model | loginForm = { form | password = password } }, Cmd.none )
 
         Login ->
             ( model, submitLogin model.loginForm )
 
+        Register ->
+            ( model, submitRegister model.loginForm )
+
         Logout ->
             ( model, W.logout )
 
@@ -1,6 +1,7 @@
 port module Worker exposing
     ( ClientMessage(..)
     , ClientState
+    , Credentials
     , Login(..)
     , Post
     , Subscription(..)
@@ -49,6 +50,18 @@ port getSubscriptionReply : (Bool -> msg) -> Sub msg
 port onLoginResult : (JD.Value -> msg) -> Sub msg
 
 
+port sendRefresh : JE.Value -> Cmd msg
+
+
+port onRefreshResult : (JD.Value -> msg) -> Sub msg
+
+
+port fetchChanges : JE.Value -> Cmd msg
+
+
+port onChangesResult : (JD.Value -> msg) -> Sub msg
+
+
 main : Program () Model Msg
 main =
     Platform.worker
@@ -74,6 +87,9 @@ type alias Model =
     , login : Maybe Login
     , db : Maybe DB.DB
     , authSaved : Bool
+    , refreshing : Bool
+    , syncToken : Maybe String
+    , syncing : Bool
     , posts : List Post
     , uuidNamespace : UUID
     , errors : List String
@@ -87,13 +103,17 @@ type Msg
     | PermissionChange P.PermissionStatus
     | StoreCreated (Result JD.Error DB.ObjectStore)
     | QueryError String
-    | LoginResult (Result JD.Error Login)
+    | LoginResult (Result String Login)
+    | CheckToken Time.Posix
+    | RefreshResult RefreshResponse
     | NewSubscription (Result JD.Error Subscription)
     | HasSubscription Bool
     | NewPost Post
     | Sync String
     | OnPutResult (Result JD.Error DB.PutResult)
     | LoginQueryResult JD.Value
+    | SyncTokenQueryResult JD.Value
+    | ChangesResult ChangesResponse
     | PostsQueryResult JD.Value
     | UploadPostResult (Result PostError UUID.UUID)
 
@@ -102,6 +122,33 @@ type alias PostError =
     String
 
 
+{-| What the server pushes, see pushMessage in app/payload.go
+-}
+type SyncMessage
+    = PostChanged ChangedPost
+    | SyncNeeded
+
+
+{-| A page of changes since the sync token, see getPostChanges in app/app.go
+-}
+type ChangesResponse
+    = Changes
+        { changes : List ( Post, Bool )
+        , token : String
+        , more : Bool
+        }
+    | ChangesFailed String
+
+
+type alias ChangedPost =
+    { post : Post
+    , deleted : Bool
+    , truncated : Bool
+    , previous : String
+    , token : String
+    }
+
+
 type PostStatus
     = Sent
     | Pending
@@ -113,8 +160,26 @@ type Login
     | LoggedIn User Token
 
 
+{-| The access token expires after an hour, the refresh token gets a new
+one before that
+-}
 type alias Token =
-    String
+    { access : String
+    , refresh : String
+    , expires : Time.Posix
+    }
+
+
+type RefreshResponse
+    = Refreshed Token
+    | RefreshRejected
+    | RefreshFailed String
+
+
+type alias Credentials =
+    { name : String
+    , password : String
+    }
 
 
 type alias User =
@@ -126,7 +191,9 @@ type alias User =
 type ClientMessage
     = Subscribe String
     | Hello
-    | Login String
+    | Login Credentials
+    | Register Credentials
+    | ExternalLogin User Token
     | Logout
     | SubmitPost String
 
@@ -183,7 +250,7 @@ encodeLogin maybe =
                     JE.object
                         [ ( "type", JE.string "logged-in" )
                         , ( "user", encodeUser user )
-                        , ( "token", JE.string token )
+                        , ( "token", encodeToken token )
                         ]
 
                 LoggedOut ->
@@ -201,7 +268,7 @@ decodeLogin =
                     "logged-in" ->
                         JD.map2 LoggedIn
                             (JD.field "user" userDecoder)
-                            (JD.field "token" JD.string)
+                            (JD.field "token" tokenDecoder)
 
                     "logged-out" ->
                         JD.succeed LoggedOut
@@ -211,6 +278,25 @@ decodeLogin =
             )
 
 
+encodeToken : Token -> JE.Value
+encodeToken token =
+    JE.object
+        [ ( "token", JE.string token.access )
+        , ( "refreshToken", JE.string token.refresh )
+        , ( "expires", JE.int (Time.posixToMillis token.expires) )
+        ]
+
+
+{-| Decodes a token pair as the server sends it
+-}
+tokenDecoder : JD.Decoder Token
+tokenDecoder =
+    JD.map3 Token
+        (JD.field "token" JD.string)
+        (JD.field "refreshToken" JD.string)
+        (JD.field "expires" (JD.map Time.millisToPosix JD.int))
+
+
 type Subscription
     = NoSubscription
     | Subscribed SubscriptionData
@@ -357,6 +443,9 @@ init _ =
       , login = Nothing
       , db = Nothing
       , authSaved = False
+      , refreshing = False
+      , syncToken = Nothing
+      , syncing = False
       , posts = []
       , errors = []
       , uuidNamespace =
@@ -479,25 +568,38 @@ update msg model =
                     JD.decodeValue decodeLogin json
             in
             case result of
+                -- the sync token is read after the login, so a sync
+                -- starts with it
                 Err err ->
                     ( { model
                         | login = Just LoggedOut
                       }
                         |> addError (JD.errorToString err)
-                    , Cmd.none
+                    , querySyncToken model.db
                     )
 
                 Ok login ->
-                    ( { model | login = Just login }, checkSubscription login )
+                    ( { model | login = Just login }
+                    , Cmd.batch
+                        [ checkSubscription login
+                        , Task.perform CheckToken Time.now
+                        , querySyncToken model.db
+                        ]
+                    )
 
         LoginResult (Err err) ->
-            ( model |> addError (JD.errorToString err), Cmd.none )
+            ( model |> addError err, Cmd.none )
 
         LoginResult (Ok login) ->
-            ( { model | login = Just login }
+            let
+                ( synced, syncCmd ) =
+                    syncPosts { model | login = Just login }
+            in
+            ( synced
             , Cmd.batch
                 [ maybePutLogin model.db login
                 , checkSubscription login
+                , syncCmd
                 ]
             )
 
@@ -514,14 +616,14 @@ update msg model =
                         Hello ->
                             ( model, Cmd.none )
 
-                        Login name ->
-                            ( model
-                            , sendLogin
-                                (JE.object
-                                    [ ( "name", JE.string name )
-                                    ]
-                                )
-                            )
+                        Login credentials ->
+                            ( model, sendLogin (encodeLoginRequest False credentials) )
+
+                        Register credentials ->
+                            ( model, sendLogin (encodeLoginRequest True credentials) )
+
+                        ExternalLogin user token ->
+                            update (LoginResult (Ok (LoggedIn user token))) model
 
                         SubmitPost text ->
                             ( model, newPost model text )
@@ -529,6 +631,55 @@ update msg model =
                         Logout ->
                             ( { model | login = Just LoggedOut }, Cmd.none )
 
+        CheckToken now ->
+            case model.login of
+                Just (LoggedIn _ token) ->
+                    if
+                        not model.refreshing
+                            && (Time.posixToMillis token.expires
+                                    - Time.posixToMillis now
+                                    < refreshMargin
+                               )
+                    then
+                        ( { model | refreshing = True }
+                        , sendRefresh
+                            (JE.object
+                                [ ( "refreshToken", JE.string token.refresh ) ]
+                            )
+                        )
+
+                    else
+                        ( model, Cmd.none )
+
+                _ ->
+                    ( model, Cmd.none )
+
+        RefreshResult response ->
+            let
+                done =
+                    { model | refreshing = False }
+            in
+            case ( response, model.login ) of
+                ( Refreshed token, Just (LoggedIn user _) ) ->
+                    let
+                        login =
+                            LoggedIn user token
+                    in
+                    ( { done | login = Just login }, maybePutLogin model.db login )
+
+                ( Refreshed _, _ ) ->
+                    -- logged out in the meantime
+                    ( done, Cmd.none )
+
+                ( RefreshRejected, _ ) ->
+                    ( { done | login = Just LoggedOut }
+                    , maybePutLogin model.db LoggedOut
+                    )
+
+                ( RefreshFailed err, _ ) ->
+                    -- try again with the next check
+                    ( done |> addError err, Cmd.none )
+
         VapidkeyResult s ->
             ( { model | vapidKey = Just s }, Cmd.none )
 
@@ -548,9 +699,70 @@ update msg model =
         HasSubscription subscription ->
             ( { model | subscription = Just subscription }, Cmd.none )
 
-        Sync _ ->
-            -- TODO do something here?
-            ( model, Cmd.none )
+        Sync json ->
+            case JD.decodeString syncMessageDecoder json of
+                Err err ->
+                    ( model |> addError (JD.errorToString err), Cmd.none )
+
+                Ok SyncNeeded ->
+                    syncPosts model
+
+                Ok (PostChanged changed) ->
+                    let
+                        store =
+                            storeChange model.db ( changed.post, changed.deleted )
+                    in
+                    -- pushes get lost or collapsed, so the token is only
+                    -- taken over when nothing was missed before this change
+                    -- and all of it was seen
+                    if
+                        not changed.truncated
+                            && (Just changed.previous == model.syncToken)
+                    then
+                        ( { model | syncToken = Just changed.token }
+                        , Cmd.batch
+                            [ store, maybePutSyncToken model.db changed.token ]
+                        )
+
+                    else
+                        let
+                            ( synced, syncCmd ) =
+                                syncPosts model
+                        in
+                        ( synced, Cmd.batch [ store, syncCmd ] )
+
+        SyncTokenQueryResult json ->
+            case JD.decodeValue (JD.nullable JD.string) json of
+                Err err ->
+                    ( model |> addError (JD.errorToString err), Cmd.none )
+
+                Ok syncToken ->
+                    syncPosts { model | syncToken = syncToken }
+
+        ChangesResult (ChangesFailed err) ->
+            ( { model | syncing = False } |> addError err, Cmd.none )
+
+        ChangesResult (Changes page) ->
+            let
+                ( synced, syncCmd ) =
+                    if page.more then
+                        syncPosts
+                            { model
+                                | syncToken = Just page.token
+                                , syncing = False
+                            }
+
+                    else
+                        ( { model | syncToken = Just page.token, syncing = False }
+                        , Cmd.none
+                        )
+            in
+            ( synced
+            , Cmd.batch
+                (List.map (storeChange model.db) page.changes
+                    ++ [ maybePutSyncToken model.db page.token, syncCmd ]
+                )
+            )
 
         NewPost post ->
             ( model
@@ -600,6 +812,71 @@ savePost maybeDb post =
                 (encodePost post)
 
 
+deletePost : Maybe DB.DB -> Post -> Cmd Msg
+deletePost maybeDb post =
+    case maybeDb of
+        Nothing ->
+            Cmd.none
+
+        Just db ->
+            DB.delete { db = db, name = "posts" } (UUID.toString post.id)
+
+
+storeChange : Maybe DB.DB -> ( Post, Bool ) -> Cmd Msg
+storeChange maybeDb ( post, deleted ) =
+    if deleted then
+        deletePost maybeDb post
+
+    else
+        savePost maybeDb post
+
+
+{-| Asks the server for the post changes since the sync token, unless that
+is under way already
+-}
+syncPosts : Model -> ( Model, Cmd Msg )
+syncPosts model =
+    case ( model.login, model.syncing ) of
+        ( Just (LoggedIn _ token), False ) ->
+            ( { model | syncing = True }
+            , authenticatedOpts token
+                (Just
+                    (JE.object
+                        [ ( "since"
+                          , JE.string (Maybe.withDefault "0" model.syncToken)
+                          )
+                        ]
+                    )
+                )
+                |> fetchChanges
+            )
+
+        _ ->
+            ( model, Cmd.none )
+
+
+{-| The sync token shares the store with the login, under its own key
+-}
+querySyncToken : Maybe DB.DB -> Cmd Msg
+querySyncToken maybeDb =
+    case maybeDb of
+        Nothing ->
+            Cmd.none
+
+        Just db ->
+            DB.get { db = db, name = "login" } (DB.GetKey "syncToken")
+
+
+maybePutSyncToken : Maybe DB.DB -> String -> Cmd Msg
+maybePutSyncToken maybeDb token =
+    case maybeDb of
+        Nothing ->
+            Cmd.none
+
+        Just db ->
+            DB.put { db = db, name = "login" } "syncToken" (JE.string token)
+
+
 maybeUploadPost : Maybe Login -> Post -> Cmd Msg
 maybeUploadPost maybeLogin post =
     case maybeLogin of
@@ -671,7 +948,7 @@ maybeSaveSubscription maybeLogin subscription =
 
 authenticatedOpts : Token -> Maybe JE.Value -> JE.Value
 authenticatedOpts token maybePayload =
-    ( "auth", JE.string token )
+    ( "auth", JE.string token.access )
         :: (case maybePayload of
                 Nothing ->
                     []
@@ -706,6 +983,9 @@ subscriptions _ =
         [ onClientMessage OnClientMessage
         , onVapidkeyResult VapidkeyResult
         , onLoginResult (decodeLoginResult >> LoginResult)
+        , onRefreshResult (decodeRefreshResult >> RefreshResult)
+        , onChangesResult (decodeChangesResult >> ChangesResult)
+        , Time.every (60 * 1000) CheckToken
         , P.onPermissionChange PermissionChange
         , DB.openResponse OnDBOpen
         , DB.createObjectStoreResult StoreCreated
@@ -755,10 +1035,14 @@ onQueryResult =
                 Err err ->
                     QueryError (JD.errorToString err)
 
-                Ok ( store, _, data ) ->
+                Ok ( store, query, data ) ->
                     case store.name of
                         "login" ->
-                            LoginQueryResult data
+                            if query == DB.GetKey "syncToken" then
+                                SyncTokenQueryResult data
+
+                            else
+                                LoginQueryResult data
 
                         "posts" ->
                             PostsQueryResult data
@@ -769,13 +1053,133 @@ onQueryResult =
         )
 
 
-decodeLoginResult : JD.Value -> Result JD.Error Login
-decodeLoginResult =
-    JD.decodeValue
-        (JD.map2 LoggedIn
-            (JD.field "user" userDecoder)
-            (JD.field "token" JD.string)
-        )
+{-| How long before the access token expires it is refreshed, in
+milliseconds
+-}
+refreshMargin : Int
+refreshMargin =
+    5 * 60 * 1000
+
+
+encodeLoginRequest : Bool -> Credentials -> JE.Value
+encodeLoginRequest register credentials =
+    JE.object
+        [ ( "register", JE.bool register )
+        , ( "name", JE.string credentials.name )
+        , ( "password", JE.string credentials.password )
+        ]
+
+
+{-| Decodes the {status, body} the service worker gets from /api/login or
+/api/register
+-}
+decodeLoginResult : JD.Value -> Result String Login
+decodeLoginResult json =
+    let
+        decoder =
+            JD.field "status" JD.int
+                |> JD.andThen
+                    (\status ->
+                        if status == 200 || status == 201 then
+                            JD.field "body" sessionDecoder |> JD.map Ok
+
+                        else
+                            JD.map Err (problemDecoder status)
+                    )
+    in
+    case JD.decodeValue decoder json of
+        Ok result ->
+            result
+
+        Err err ->
+            Err (JD.errorToString err)
+
+
+{-| Decodes the user and tokens of a new session, see startSession in
+app/app.go
+-}
+sessionDecoder : JD.Decoder Login
+sessionDecoder =
+    JD.map2 LoggedIn
+        (JD.field "user" userDecoder)
+        tokenDecoder
+
+
+{-| Decodes the {status, body} the service worker gets from /api/token
+-}
+decodeRefreshResult : JD.Value -> RefreshResponse
+decodeRefreshResult json =
+    let
+        decoder =
+            JD.field "status" JD.int
+                |> JD.andThen
+                    (\status ->
+                        case status of
+                            200 ->
+                                JD.field "body" tokenDecoder |> JD.map Refreshed
+
+                            401 ->
+                                JD.succeed RefreshRejected
+
+                            _ ->
+                                JD.map RefreshFailed (problemDecoder status)
+                    )
+    in
+    case JD.decodeValue decoder json of
+        Ok response ->
+            response
+
+        Err err ->
+            RefreshFailed (JD.errorToString err)
+
+
+{-| Decodes the {status, body} the service worker gets from /api/posts?since=
+-}
+decodeChangesResult : JD.Value -> ChangesResponse
+decodeChangesResult json =
+    let
+        change =
+            JD.map2 Tuple.pair serverPostDecoder (optionalBool [ "deleted" ])
+
+        decoder =
+            JD.field "status" JD.int
+                |> JD.andThen
+                    (\status ->
+                        if status == 200 then
+                            JD.field "body"
+                                (JD.map3
+                                    (\changes token more ->
+                                        Changes
+                                            { changes = changes
+                                            , token = token
+                                            , more = more
+                                            }
+                                    )
+                                    (JD.field "posts" (JD.list change))
+                                    (JD.field "token" JD.string)
+                                    (JD.field "more" JD.bool)
+                                )
+
+                        else
+                            JD.map ChangesFailed (problemDecoder status)
+                    )
+    in
+    case JD.decodeValue decoder json of
+        Ok response ->
+            response
+
+        Err err ->
+            ChangesFailed (JD.errorToString err)
+
+
+{-| Reads the detail of an application/problem+json body
+-}
+problemDecoder : Int -> JD.Decoder String
+problemDecoder status =
+    JD.oneOf
+        [ JD.at [ "body", "detail" ] JD.string
+        , JD.succeed ("unexpected response: " ++ String.fromInt status)
+        ]
 
 
 postsDecoder : JD.Decoder (List Post)
@@ -798,6 +1202,46 @@ postsDecoder =
         )
 
 
+syncMessageDecoder : JD.Decoder SyncMessage
+syncMessageDecoder =
+    JD.field "type" JD.string
+        |> JD.andThen
+            (\type_ ->
+                case type_ of
+                    "post" ->
+                        JD.map5 ChangedPost
+                            (JD.field "post" serverPostDecoder)
+                            (optionalBool [ "post", "deleted" ])
+                            (optionalBool [ "truncated" ])
+                            (JD.field "previous" JD.string)
+                            (JD.field "token" JD.string)
+                            |> JD.map PostChanged
+
+                    -- unknown types ask for a sync as well
+                    _ ->
+                        JD.succeed SyncNeeded
+            )
+
+
+{-| Decodes a post as the server sends it, so it counts as sent
+-}
+serverPostDecoder : JD.Decoder Post
+serverPostDecoder =
+    JD.map5 Post
+        (JD.field "id" uuidDecoder)
+        (JD.field "user" userDecoder)
+        (JD.field "time" (JD.map Time.millisToPosix JD.int))
+        (JD.field "text" JD.string)
+        (JD.succeed Sent)
+
+
+{-| Decodes a bool left out when false
+-}
+optionalBool : List String -> JD.Decoder Bool
+optionalBool path =
+    JD.oneOf [ JD.at path JD.bool, JD.succeed False ]
+
+
 userDecoder : JD.Decoder User
 userDecoder =
     JD.map2 User
@@ -829,10 +1273,31 @@ encodeClientMessage cm =
                 , ( "key", JE.string key )
                 ]
 
-        Login name ->
+        Login credentials ->
             JE.object
                 [ ( "type", JE.string "login" )
-                , ( "name", JE.string name )
+                , ( "name", JE.string credentials.name )
+                , ( "password", JE.string credentials.password )
+                ]
+
+        Register credentials ->
+            JE.object
+                [ ( "type", JE.string "register" )
+                , ( "name", JE.string credentials.name )
+                , ( "password", JE.string credentials.password )
+                ]
+
+        ExternalLogin user token ->
+            JE.object
+                [ ( "type", JE.string "external-login" )
+                , ( "session"
+                  , JE.object
+                        [ ( "user", encodeUser user )
+                        , ( "token", JE.string token.access )
+                        , ( "refreshToken", JE.string token.refresh )
+                        , ( "expires", JE.int (Time.posixToMillis token.expires) )
+                        ]
+                  )
                 ]
 
         Logout ->
@@ -863,8 +1328,19 @@ decodeClientMessage =
                             |> JD.andThen (\key -> JD.succeed (Subscribe key))
 
                     "login" ->
-                        JD.field "name" JD.string
-                            |> JD.andThen (\name -> JD.succeed (Login name))
+                        JD.map Login credentialsDecoder
+
+                    "register" ->
+                        JD.map Register credentialsDecoder
+
+                    -- the session the server handed over in the fragment
+                    -- after a login with the identity provider
+                    "external-login" ->
+                        JD.field "session"
+                            (JD.map2 ExternalLogin
+                                (JD.field "user" userDecoder)
+                                tokenDecoder
+                            )
 
                     "post" ->
                         JD.field "text" JD.string
@@ -879,3 +1355,10 @@ decodeClientMessage =
                     _ ->
                         JD.fail <| "unknown message type: " ++ typ
             )
+
+
+credentialsDecoder : JD.Decoder Credentials
+credentialsDecoder =
+    JD.map2 Credentials
+        (JD.field "name" JD.string)
+        (JD.field "password" JD.string)
@@ -4,9 +4,17 @@ import (
 	"context"
 	"crypto/elliptic"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
 	"github.com/google/uuid"
@@ -15,17 +23,23 @@ import (
 var curve = elliptic.P256()
 
 type Subscription struct {
-	UserID   uuid.UUID `json:"-" datastore:"-"`
-	Endpoint string    `json:"endpoint"`
-	P256dh   string    `json:"p256dh"`
-	Auth     string    `json:"auth"`
+	UserID    uuid.UUID `json:"-" datastore:"-"`
+	SessionID uuid.UUID `json:"-" datastore:"-"`
+	Endpoint  string    `json:"endpoint"`
+	P256dh    string    `json:"p256dh"`
+	Auth      string    `json:"auth"`
 }
 
 type Post struct {
-	ID   uuid.UUID `json:"id" datastore:"-"`
-	User User      `json:"user"`
-	Text string    `json:"text"`
-	Time Time      `json:"time"`
+	ID      uuid.UUID `json:"id" datastore:"-"`
+	User    User      `json:"user"`
+	Text    string    `json:"text"`
+	Time    Time      `json:"time"`
+	Edited  *Time     `json:"edited,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+	// Version is assigned by the DB on every write and counts up by one
+	// across all posts, it backs the sync token
+	Version int64 `json:"-"`
 }
 
 type KeyPair struct {
@@ -34,66 +48,77 @@ type KeyPair struct {
 }
 
 type App struct {
-	db   DB
-	user UserService
-	http HttpHandler
+	db    DB
+	user  UserService
+	http  HttpHandler
+	push  PushConfig
+	tasks Tasks
 }
 
-func New(db DB, user UserService, handler HttpHandler) App {
-	return App{db, user, handler}
+func New(db DB, user UserService, handler HttpHandler, push PushConfig,
+	tasks Tasks) App {
+
+	return App{db, user, handler, push.withDefaults(), tasks}
 }
 
 func (app *App) Run(port string) error {
-	app.http.HandleFunc("/vapid-public-key", app.getPublicKey)
-	app.HandleFuncAuthed("/api/subscription", methodHandler{
-		post: app.postSubscription,
-		get:  app.getSubscription,
-	}.handle)
-	app.HandleFuncAuthed("/api/posts", methodHandler{
-		post: app.postPost,
-		get:  app.getPosts,
-	}.handle)
-	app.http.HandleFunc("/api/login", app.login)
-
-	return app.http.ListenAndServe(":"+port, nil)
-}
+	r := NewRouter()
+	r.Handle("GET", "/vapid-public-key", app.getPublicKey)
+	r.Handle("POST", "/api/register", app.register)
+	r.Handle("POST", "/api/login", app.login)
+	r.Handle("POST", "/api/token", app.postToken)
+	r.Handle("GET", "/api/oidc/login", app.startExternalLogin)
+	r.Handle("GET", "/api/oidc/callback", app.finishExternalLogin)
+	r.Handle("POST", "/api/logout", app.authed(app.logout))
+	r.Handle("GET", "/api/sessions", app.authed(app.getSessions))
+	r.Handle("DELETE", "/api/sessions", app.authed(app.deleteSessions))
+	r.Handle("DELETE", "/api/sessions/{id}", app.authed(app.deleteSession))
+	r.Handle("GET", "/api/users/me", app.authed(app.getMe))
+	r.Handle("PATCH", "/api/users/me", app.authed(app.patchMe))
+	r.Handle("PUT", "/api/users/me/avatar", app.authed(app.putAvatar))
+	r.Handle("DELETE", "/api/users/me/avatar", app.authed(app.deleteMyAvatar))
+	r.Handle("GET", "/api/users/me/following", app.authed(app.getFollowing))
+	r.Handle("GET", "/api/users/me/followers", app.authed(app.getFollowers))
+	r.Handle("GET", "/api/users/{id}", app.authed(app.getUserProfile))
+	r.Handle("PUT", "/api/users/{id}/follow", app.authed(app.putFollow))
+	r.Handle("DELETE", "/api/users/{id}/follow", app.authed(app.deleteFollow))
+	r.Handle("GET", "/api/avatars/{id}/{size}", app.getAvatar)
+	r.Handle("GET", "/api/notification-settings",
+		app.authed(app.getNotificationSettings))
+	r.Handle("PUT", "/api/notification-settings",
+		app.authed(app.putNotificationSettings))
+	r.Handle("GET", "/api/subscription", app.authed(app.getSubscription))
+	r.Handle("POST", "/api/subscription", app.authed(app.postSubscription))
+	r.Handle("DELETE", "/api/subscription", app.authed(app.deleteSubscription))
+	r.Handle("GET", "/api/posts", app.authed(app.getPosts))
+	r.Handle("POST", "/api/posts", app.authed(app.postPost))
+	r.Handle("POST", "/api/posts/batch", app.authed(app.postPosts))
+	r.Handle("PUT", "/api/posts/{id}", app.authed(app.putPost))
+	r.Handle("PATCH", "/api/posts/{id}", app.authed(app.putPost))
+	r.Handle("DELETE", "/api/posts/{id}", app.authed(app.deletePost))
+	r.Handle("POST", "/api/tasks/{kind}", app.runTask)
 
-type methodHandler struct {
-	get  func(http.ResponseWriter, *http.Request)
-	post func(http.ResponseWriter, *http.Request)
-}
+	h := withRequestID(r)
+	app.http.HandleFunc("/vapid-public-key", h)
+	app.http.HandleFunc("/api/", h)
 
-func (mh methodHandler) handle(w http.ResponseWriter, req *http.Request) {
-	switch req.Method {
-	case "GET":
-		if mh.get != nil {
-			mh.get(w, req)
-			return
-		}
-	case "POST":
-		if mh.post != nil {
-			mh.post(w, req)
-			return
-		}
-	default:
+	if runner, ok := app.tasks.(TaskRunner); ok {
+		runner.Start(h)
 	}
 
-	w.WriteHeader(http.StatusMethodNotAllowed)
+	return app.http.ListenAndServe(":"+port, nil)
 }
 
-func (app *App) HandleFuncAuthed(path string, handle func(http.ResponseWriter,
-	*http.Request)) {
-
-	app.http.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+func (app *App) authed(handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
 		ctx, err := app.user.Decorate(req)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			msg := fmt.Sprintf("no/wrong authorization header provided (%v)", err)
-			w.Write([]byte(msg))
+			writeError(w, req, http.StatusUnauthorized, codeUnauthorized,
+				"no/wrong authorization header provided", err)
 			return
 		}
 		handle(w, req.WithContext(ctx))
-	})
+	}
 }
 
 func (app *App) getPublicKey(w http.ResponseWriter, req *http.Request) {
@@ -106,28 +131,25 @@ func (app *App) getPublicKey(w http.ResponseWriter, req *http.Request) {
 	case ErrNoSuchEntity:
 		sk, pk, err2 := webpush.GenerateVAPIDKeys()
 		if err2 != nil {
-			msg := fmt.Sprintf("could not create VAPID keypair (%v)", err2)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(msg))
+			writeError(w, req, http.StatusInternalServerError, codeInternal,
+				"could not create VAPID keypair", err2)
 			return
 		}
 		k.PK = pk
 		k.SK = sk
 		err2 = app.db.PutKey(ctx, k)
 		if err2 != nil {
-			msg := fmt.Sprintf("could not save VAPID keypair (%v)", err2)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(msg))
+			writeError(w, req, http.StatusInternalServerError, codeInternal,
+				"could not save VAPID keypair", err2)
 			return
 		}
-		// all ok
+		w.Write([]byte(k.PK))
 	case nil:
 		w.Write([]byte(k.PK))
 	// other error
 	default:
-		msg := fmt.Sprintf("could not get VAPID keypair (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get VAPID keypair", err)
 		return
 	}
 
@@ -140,131 +162,580 @@ func (app *App) postSubscription(w http.ResponseWriter, req *http.Request) {
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&s)
 	if err != nil {
-		msg := fmt.Sprintf("could not unmarshal json body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not unmarshal json body", err)
+		return
+	}
+	if s.Endpoint == "" {
+		writeFieldError(w, req, "endpoint", "is required")
 		return
 	}
 
 	uid := app.user.Current(ctx)
 	s.UserID = uid
+	s.SessionID = app.user.CurrentSession(ctx)
 
 	err = app.db.CreateSubscription(ctx, s)
 	if err != nil {
-		msg := fmt.Sprintf("could not create subscription (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not create subscription", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
+
+// getSubscription lists the subscriptions of the user and the latest removed
+// ones. With ?endpoint= it only tells whether that device is subscribed, by
+// answering 204 or 404.
 func (app *App) getSubscription(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-
 	uid := app.user.Current(ctx)
-	_, err := app.db.ReadSubscription(ctx, uid)
+
+	if endpoint := req.URL.Query().Get("endpoint"); endpoint != "" {
+		s, err := app.db.GetSubscription(ctx, endpoint)
+		switch {
+		case err == nil && s.UserID == uid:
+			w.WriteHeader(http.StatusNoContent)
+		case err == nil || err == ErrNoSuchEntity:
+			writeError(w, req, http.StatusNotFound, codeNotFound,
+				"no subscription found", nil)
+		default:
+			writeError(w, req, http.StatusInternalServerError, codeInternal,
+				"could not read subscription", err)
+		}
+		return
+	}
+
+	ss, err := app.db.ReadSubscriptions(ctx, uid)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not read subscriptions", err)
+		return
+	}
+	rs, err := app.db.ReadSubscriptionRemovals(ctx, uid)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not read subscription removals", err)
+		return
+	}
+	if len(rs) > maxListedRemovals {
+		rs = rs[:maxListedRemovals]
+	}
+
+	json, err := json.Marshal(struct {
+		Subscriptions []Subscription        `json:"subscriptions"`
+		Removed       []SubscriptionRemoval `json:"removed"`
+	}{ss, rs})
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal subscriptions", err)
+		return
+	}
+	w.Write(json)
+}
+
+// deleteSubscription unsubscribes the device with the ?endpoint= of the
+// subscription
+func (app *App) deleteSubscription(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	endpoint := req.URL.Query().Get("endpoint")
+	if endpoint == "" {
+		writeFieldError(w, req, "endpoint", "is required")
+		return
+	}
+
+	s, err := app.db.GetSubscription(ctx, endpoint)
+	if err == nil && s.UserID != app.user.Current(ctx) {
+		err = ErrNoSuchEntity
+	}
+	if err == nil {
+		err = app.db.DeleteSubscription(ctx, endpoint, RemovalUnsubscribed)
+	}
 	switch err {
 	case nil:
-		w.WriteHeader(http.StatusNoContent)
 	case ErrNoSuchEntity:
-		msg := fmt.Sprintf("no subscription found (%v)", err)
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"no subscription found", nil)
 		return
 	default:
-		msg := fmt.Sprintf("could not read subscription (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not delete subscription", err)
 		return
 	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
 }
 
 func (app *App) register(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 
-	u := User{}
-	err := json.NewDecoder(req.Body).Decode(&u)
+	c := credentials{}
+	err := json.NewDecoder(req.Body).Decode(&c)
 	if err != nil {
-		msg := fmt.Sprintf("could not decode json body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not decode json body", err)
+		return
+	}
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		writeFieldError(w, req, "name", "is required")
+		return
+	}
+	if err = ValidatePassword(c.Password); err != nil {
+		writeFieldError(w, req, "password", err.Error())
+		return
+	}
+
+	u, err := app.user.Register(ctx, c.Name, c.Password)
+	switch err {
+	case nil:
+	case ErrNameTaken:
+		writeError(w, req, http.StatusConflict, codeNameTaken,
+			"the name is taken", nil)
+		return
+	case ErrExternalLogin:
+		writeError(w, req, http.StatusForbidden, codeExternalLogin,
+			"register with the identity provider", nil)
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not register user", err)
 		return
 	}
 
-	u, err = app.user.Register(ctx, u.Name)
+	app.startSession(w, req, u, http.StatusCreated)
+}
+
+func (app *App) login(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	c := credentials{}
+	err := json.NewDecoder(req.Body).Decode(&c)
 	if err != nil {
-		msg := fmt.Sprintf("could not get posts from db: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not decode json body", err)
+		return
+	}
+
+	u, err := app.user.Login(ctx, c.Name, c.Password)
+	switch err {
+	case nil:
+	case ErrInvalidCredentials:
+		writeError(w, req, http.StatusUnauthorized, codeInvalidCredentials,
+			"wrong name or password", nil)
+		return
+	case ErrExternalLogin:
+		writeError(w, req, http.StatusForbidden, codeExternalLogin,
+			"log in with the identity provider", nil)
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not log in", err)
 		return
 	}
 
-	json, err := json.Marshal(u)
+	app.startSession(w, req, u, http.StatusOK)
+}
+
+func (app *App) logout(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	err := app.user.Revoke(ctx, app.user.CurrentSession(ctx))
 	if err != nil {
-		msg := fmt.Sprintf("could not marshal posts (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not end session", err)
 		return
 	}
-	w.Write(json)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (app *App) login(w http.ResponseWriter, req *http.Request) {
+type sessionInfo struct {
+	Session
+	Current bool `json:"current"`
+}
+
+// getSessions lists the sessions of the user that are still alive
+func (app *App) getSessions(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 
-	u := User{}
-	err := json.NewDecoder(req.Body).Decode(&u)
+	ss, err := app.activeSessions(ctx)
 	if err != nil {
-		msg := fmt.Sprintf("could not decode json body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not read sessions", err)
 		return
 	}
 
-	u2, err := app.user.GetUserByName(ctx, u.Name)
+	current := app.user.CurrentSession(ctx)
+	r := struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}{Sessions: make([]sessionInfo, len(ss))}
+	for i, s := range ss {
+		r.Sessions[i] = sessionInfo{Session: s, Current: s.ID == current}
+	}
+
+	json, err := json.Marshal(r)
 	if err != nil {
-		// just assume the user is missing, other errors will show up again soon
-		u2, err = app.user.Register(ctx, u.Name)
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal sessions", err)
+		return
+	}
+	w.Write(json)
+}
+
+func (app *App) deleteSessions(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	ss, err := app.activeSessions(ctx)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not read sessions", err)
+		return
+	}
+	for _, s := range ss {
+		err = app.user.Revoke(ctx, s.ID)
 		if err != nil {
-			msg := fmt.Sprintf("could not get user from db: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(msg))
+			writeError(w, req, http.StatusInternalServerError, codeInternal,
+				"could not end session", err)
 			return
 		}
 	}
 
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *App) deleteSession(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	id, err := uuid.Parse(PathParam(req, "id"))
+	if err != nil {
+		writeFieldError(w, req, "id", "must be a uuid")
+		return
+	}
+	s, err := app.db.GetSession(ctx, id)
+	if err != nil && err != ErrNoSuchEntity {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not read session", err)
+		return
+	}
+	// sessions of others are none of the user's business
+	if err == ErrNoSuchEntity || s.UserID != app.user.Current(ctx) ||
+		s.Revoked {
+
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"no such session", nil)
+		return
+	}
+
+	err = app.user.Revoke(ctx, s.ID)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not end session", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// activeSessions returns the sessions of the current user that are neither
+// revoked nor expired, the most recently used first
+func (app *App) activeSessions(ctx context.Context) ([]Session, error) {
+	ss, err := app.db.ReadSessions(ctx, app.user.Current(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := []Session{}
+	for _, s := range ss {
+		if !s.Revoked && now.Before(s.Expires.Time) {
+			active = append(active, s)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].LastSeen.After(active[j].LastSeen.Time)
+	})
+	return active, nil
+}
+
+const loginCookie = "external_login"
+
+// startExternalLogin sends the user agent to the identity provider. The
+// login secret is kept in a cookie only sent back to the callback.
+func (app *App) startExternalLogin(w http.ResponseWriter, req *http.Request) {
+	ext, ok := app.user.(ExternalLogin)
+	if !ok {
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"there is no identity provider", nil)
+		return
+	}
+
+	url, secret, err := ext.StartLogin(req.Context())
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not start login", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    secret,
+		Path:     "/api/oidc/callback",
+		MaxAge:   600,
+		Secure:   !isLocalhost(req),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, url, http.StatusFound)
+}
+
+// isLocalhost tells whether req was made to this machine, where there is no
+// TLS during development. Elsewhere a proxy in front might have ended it.
+func isLocalhost(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = strings.Trim(req.Host, "[]")
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (app *App) finishExternalLogin(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	ext, ok := app.user.(ExternalLogin)
+	if !ok {
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"there is no identity provider", nil)
+		return
+	}
+	c, err := req.Cookie(loginCookie)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, codeInvalidParameter,
+			"no login in progress", nil)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   loginCookie,
+		Path:   "/api/oidc/callback",
+		MaxAge: -1,
+	})
+
+	u, err := ext.FinishLogin(ctx, c.Value, req.URL.Query())
+	switch err {
+	case nil:
+	case ErrInvalidCredentials:
+		writeError(w, req, http.StatusUnauthorized, codeInvalidCredentials,
+			"the identity provider did not log you in", nil)
+		return
+	case ErrInvalidToken:
+		writeError(w, req, http.StatusUnauthorized, codeInvalidToken,
+			"the identity provider sent an invalid token", nil)
+		return
+	default:
+		writeError(w, req, http.StatusBadGateway, codeInternal,
+			"could not finish login", err)
+		return
+	}
+
+	json, err := app.newSession(req, u)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not start session", err)
+		return
+	}
+
+	// this is a navigation of the browser, so the app gets the session in
+	// the fragment, which is neither sent to servers nor in the referrer.
+	// http.Redirect would clean it like a path.
+	w.Header().Set("Location", "/#login="+url.PathEscape(string(json)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// startSession answers a successful login or registration with the user and
+// the tokens of a new session
+func (app *App) startSession(w http.ResponseWriter, req *http.Request, u User,
+	status int) {
+
+	json, err := app.newSession(req, u)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not start session", err)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(json)
+}
+
+// newSession issues the tokens of a new session of u and describes them
+// together with the user
+func (app *App) newSession(req *http.Request, u User) ([]byte, error) {
+	tp, err := app.user.Issue(req.Context(), u, req.UserAgent())
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		User User `json:"user"`
+		TokenPair
+	}{User: u, TokenPair: tp})
+}
+
+func (app *App) postToken(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
 	r := struct {
-		User  User   `json:"user"`
-		Token string `json:"token"`
-	}{User: u2, Token: u2.ID.String()}
+		Refresh string `json:"refreshToken"`
+	}{}
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not decode json body", err)
+		return
+	}
 
-	json, err := json.Marshal(r)
+	tp, err := app.user.Refresh(ctx, r.Refresh)
+	switch err {
+	case nil:
+	case ErrInvalidToken:
+		writeError(w, req, http.StatusUnauthorized, codeInvalidToken,
+			"refresh token is invalid, expired or revoked", nil)
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not refresh session", err)
+		return
+	}
+
+	json, err := json.Marshal(tp)
 	if err != nil {
-		msg := fmt.Sprintf("could not marshal posts (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal tokens", err)
 		return
 	}
 	w.Write(json)
 }
 
+const (
+	defaultPostsLimit = 50
+	maxPostsLimit     = 200
+)
+
+type postsPage struct {
+	Posts []Post `json:"posts"`
+	Next  string `json:"next,omitempty"`
+}
+
+// postChanges is a batch of posts changed after a sync token. Clients keep
+// asking with the returned token until More is false.
+type postChanges struct {
+	Posts []Post `json:"posts"`
+	Token string `json:"token"`
+	More  bool   `json:"more"`
+}
+
 func (app *App) getPosts(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
+	query := req.URL.Query()
+
+	limit := defaultPostsLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxPostsLimit {
+			writeFieldError(w, req, "limit", fmt.Sprintf(
+				"must be a number between 1 and %d", maxPostsLimit))
+			return
+		}
+	}
+
+	if _, ok := query["since"]; ok {
+		app.getPostChanges(w, req, query.Get("since"), limit)
+		return
+	}
 
-	ps, err := app.db.ReadPosts(ctx)
+	ps, next, err := app.db.ReadPosts(ctx, query.Get("cursor"), limit)
+	switch err {
+	case nil:
+	case ErrInvalidCursor:
+		writeFieldError(w, req, "cursor", "not a cursor of this listing")
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get posts from db", err)
+		return
+	}
+	err = app.withAuthors(ctx, ps)
 	if err != nil {
-		msg := fmt.Sprintf("could not get posts from db: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get authors of posts", err)
 		return
 	}
 
-	json, err := json.Marshal(&ps)
+	json, err := json.Marshal(postsPage{Posts: ps, Next: next})
 	if err != nil {
-		msg := fmt.Sprintf("could not marshal posts (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal posts", err)
+		return
+	}
+	w.Write(json)
+}
+
+func (app *App) getPostChanges(w http.ResponseWriter, req *http.Request,
+	token string, limit int) {
+	ctx := req.Context()
+
+	// the token is the highest post version the client has seen, "0" gets
+	// everything
+	since, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || since < 0 {
+		writeFieldError(w, req, "since", "not a sync token")
+		return
+	}
+
+	ps, err := app.db.ReadPostChanges(ctx, since, limit)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get post changes from db", err)
+		return
+	}
+
+	for i := range ps {
+		if ps[i].Deleted {
+			// tombstones only need to tell which post is gone
+			ps[i].Text = ""
+		}
+		if ps[i].Version > since {
+			since = ps[i].Version
+		}
+	}
+	err = app.withAuthors(ctx, ps)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get authors of posts", err)
+		return
+	}
+
+	json, err := json.Marshal(postChanges{
+		Posts: ps,
+		Token: strconv.FormatInt(since, 10),
+		More:  len(ps) == limit,
+	})
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal posts", err)
 		return
 	}
 	w.Write(json)
@@ -275,9 +746,8 @@ func (app *App) postPost(w http.ResponseWriter, req *http.Request) {
 
 	u, err := app.getUser(ctx)
 	if err != nil {
-		msg := fmt.Sprintf("could not get user (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
 		return
 	}
 
@@ -285,76 +755,326 @@ func (app *App) postPost(w http.ResponseWriter, req *http.Request) {
 	p := Post{}
 	err = decoder.Decode(&p)
 	if err != nil {
-		msg := fmt.Sprintf("could not read json body key (%v)", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(msg))
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not read json body", err)
 		return
 	}
+	// clients send their own IDs so retries don't create duplicates
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
 
-	p.User = u
-	p.ID = uuid.New()
-	err = app.db.PutPost(ctx, p)
-	if err != nil {
-		msg := fmt.Sprintf("could not save post (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+	created, err := app.createPost(ctx, u, p)
+	switch err {
+	case nil:
+	case errPostOfOtherUser:
+		writeError(w, req, http.StatusConflict, codeConflict,
+			"post ID is taken by another user", nil)
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not save post", err)
 		return
 	}
 
-	// send push
-	err = app.notifyAll(ctx)
-	if err != nil {
-		msg := fmt.Sprintf("could not notify clients (%v)", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(msg))
+	if !created {
+		// a retry, answer like the first time without notifying again
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(p.ID.String()))
 		return
 	}
 
+	// new posts are news for followers, others see them on their next sync
+	err = app.notify(ctx, ClassNewPost, u.ID, p.ID, followersOf(u.ID))
+	if err == nil {
+		err = app.notifyMentions(ctx, u.ID, p)
+	}
+	if err != nil {
+		// the post is stored and a retry would not notify again, clients
+		// will learn about it on sync
+		log.Printf("could not notify clients (%v)", err)
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte(p.ID.String()))
 }
 
-func (app *App) getUser(ctx context.Context) (User, error) {
-	id := app.user.Current(ctx)
+const (
+	maxBatchSize = 100
+	// maxBatchBytes caps the body of a batch, its posts can only be
+	// counted after decoding
+	maxBatchBytes = 1 << 20
+)
 
-	u, err := app.db.GetUser(ctx, id)
-	return u, err
+// batchResult is the outcome for one post of a batch upload, Status is
+// what a single POST /api/posts would have answered
+type batchResult struct {
+	ID     uuid.UUID `json:"id"`
+	Status int       `json:"status"`
+	Code   string    `json:"code,omitempty"`
+	Error  string    `json:"error,omitempty"`
 }
 
-func (app *App) notifyAll(ctx context.Context) error {
-	// get server keys
-	k, err := app.db.GetKey(ctx)
+// postPosts stores a batch of posts, as queued up by offline clients. Each
+// post succeeds or fails on its own and all new ones share one push.
+func (app *App) postPosts(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	u, err := app.getUser(ctx)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+
+	bs, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBatchBytes))
+	if err != nil {
+		writeError(w, req, http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("batches can be at most %d bytes", maxBatchBytes),
+			nil)
+		return
+	}
+	ps := []Post{}
+	err = json.Unmarshal(bs, &ps)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not read json body", err)
+		return
+	}
+	if len(ps) > maxBatchSize {
+		msg := fmt.Sprintf("batch holds %d posts, at most %d are allowed",
+			len(ps), maxBatchSize)
+		writeError(w, req, http.StatusRequestEntityTooLarge, codeTooLarge, msg,
+			nil)
+		return
+	}
+
+	rs := make([]batchResult, len(ps))
+	created := []Post{}
+	for i, p := range ps {
+		if p.ID == uuid.Nil {
+			rs[i] = batchResult{Status: http.StatusBadRequest,
+				Code: codeInvalidParameter, Error: "post has no id"}
+			continue
+		}
+		isNew, err := app.createPost(ctx, u, p)
+		switch err {
+		case nil:
+			rs[i] = batchResult{ID: p.ID, Status: http.StatusCreated}
+		case errPostOfOtherUser:
+			rs[i] = batchResult{ID: p.ID, Status: http.StatusConflict,
+				Code: codeConflict, Error: err.Error()}
+		default:
+			log.Printf("request %v: could not save post %v of batch (%v)",
+				requestID(ctx), p.ID, err)
+			rs[i] = batchResult{ID: p.ID,
+				Status: http.StatusInternalServerError,
+				Code:   codeInternal, Error: "could not save post"}
+		}
+		if isNew {
+			created = append(created, p)
+		}
+	}
+
+	if len(created) > 0 {
+		// a push can describe one post, more need a sync
+		id := uuid.Nil
+		if len(created) == 1 {
+			id = created[0].ID
+		}
+		err = app.notify(ctx, ClassNewPost, u.ID, id, followersOf(u.ID))
+		for i := 0; err == nil && i < len(created); i++ {
+			err = app.notifyMentions(ctx, u.ID, created[i])
+		}
+		if err != nil {
+			// the posts are stored, clients will learn about them on sync
+			log.Printf("could not notify clients (%v)", err)
+		}
+	}
+
+	json, err := json.Marshal(rs)
 	if err != nil {
-		return fmt.Errorf("could not get server key: %v", err)
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal results", err)
+		return
+	}
+	w.Write(json)
+}
+
+var errPostOfOtherUser = errors.New("post ID is taken by another user")
+
+// createPost stores p as a new post of u. Repeating the creation of a post is
+// fine and reported by created being false.
+func (app *App) createPost(ctx context.Context, u User, p Post) (created bool,
+	err error) {
+
+	p.User = u
+	p.Edited = nil
+	p.Deleted = false
+	stored, err := app.db.CreatePost(ctx, p)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrEntityExists:
+		if stored.User.ID != u.ID {
+			return false, errPostOfOtherUser
+		}
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// postEdit is the editable part of a post, fields left out stay as they are
+type postEdit struct {
+	Text *string `json:"text"`
+}
+
+func (app *App) putPost(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	p, ok := app.authoredPost(w, req)
+	if !ok {
+		return
 	}
-	// get user keys
-	ss, err := app.db.ReadAllSubscriptions(ctx)
+
+	e := postEdit{}
+	err := json.NewDecoder(req.Body).Decode(&e)
 	if err != nil {
-		return err
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not read json body", err)
+		return
+	}
+	if req.Method == "PUT" && e.Text == nil {
+		writeFieldError(w, req, "text", "is required")
+		return
 	}
 
-	log.Printf("notifying 1 user on %d subscriptions", len(ss))
+	if e.Text != nil && *e.Text != p.Text {
+		p.Text = *e.Text
+		p.Edited = &Time{time.Now()}
+		err = app.db.PutPost(ctx, p)
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, codeInternal,
+				"could not save post", err)
+			return
+		}
 
-	// send pushes to each sub
-	for _, s := range ss {
-		ws := webpush.Subscription{}
-		ws.Endpoint = s.Endpoint
-		ws.Keys = webpush.Keys{}
-		ws.Keys.Auth = s.Auth
-		ws.Keys.P256dh = s.P256dh
-
-		// Send Notification
-		res, err := webpush.SendNotification([]byte("msg-sync"), &ws, &webpush.Options{
-			Subscriber:      "<mh@lambdasoup.com>",
-			VAPIDPrivateKey: k.SK,
-			VAPIDPublicKey:  k.PK,
-			TTL:             30,
-		})
-		log.Printf("%v", res)
+		// anyone might hold a copy of the post
+		err = app.notify(ctx, ClassPostChanged, p.User.ID, p.ID,
+			everyoneBut(p.User.ID))
 		if err != nil {
-			log.Printf("could not send notification: %v", err)
+			// the edit is stored, clients will learn about it on sync
+			log.Printf("could not notify clients (%v)", err)
 		}
 	}
 
+	ps := []Post{p}
+	err = app.withAuthors(ctx, ps)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get author of post", err)
+		return
+	}
+
+	json, err := json.Marshal(ps[0])
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal post", err)
+		return
+	}
+	w.Write(json)
+}
+
+func (app *App) deletePost(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	p, ok := app.authoredPost(w, req)
+	if !ok {
+		return
+	}
+
+	// leave a tombstone, so clients can learn about the deletion on sync
+	p.Deleted = true
+	p.Text = ""
+	p.Edited = &Time{time.Now()}
+	err := app.db.PutPost(ctx, p)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not delete post", err)
+		return
+	}
+
+	err = app.notify(ctx, ClassPostChanged, p.User.ID, p.ID,
+		everyoneBut(p.User.ID))
+	if err != nil {
+		log.Printf("could not notify clients (%v)", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authoredPost reads the post from the request path and makes sure the
+// current user wrote it. If not, it has answered the request already.
+func (app *App) authoredPost(w http.ResponseWriter, req *http.Request) (Post,
+	bool) {
+
+	ctx := req.Context()
+
+	id, err := uuid.Parse(PathParam(req, "id"))
+	if err != nil {
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"invalid post id", nil)
+		return Post{}, false
+	}
+
+	p, err := app.db.GetPost(ctx, id)
+	switch {
+	case err == ErrNoSuchEntity || err == nil && p.Deleted:
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			fmt.Sprintf("no post %v", id), nil)
+		return Post{}, false
+	case err != nil:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not read post", err)
+		return Post{}, false
+	}
+
+	if p.User.ID != app.user.Current(ctx) {
+		writeError(w, req, http.StatusForbidden, codeForbidden,
+			fmt.Sprintf("post %v belongs to another user", id), nil)
+		return Post{}, false
+	}
+
+	return p, true
+}
+
+func (app *App) getUser(ctx context.Context) (User, error) {
+	id := app.user.Current(ctx)
+
+	u, err := app.db.GetUser(ctx, id)
+	return u, err
+}
+
+// withAuthors fills in the users of posts, which the DB only keeps the ID of.
+// Posts of deleted users keep just the ID.
+func (app *App) withAuthors(ctx context.Context, ps []Post) error {
+	us := map[uuid.UUID]User{}
+	for i := range ps {
+		id := ps[i].User.ID
+		u, ok := us[id]
+		if !ok {
+			var err error
+			u, err = app.db.GetUser(ctx, id)
+			if err == ErrNoSuchEntity {
+				u, err = User{ID: id}, nil
+			}
+			if err != nil {
+				return err
+			}
+			us[id] = u
+		}
+		ps[i].User = u
+	}
 	return nil
 }
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Audience tells who a notification is for
+type Audience struct {
+	Kind string `json:"kind"`
+	// Except is left out of any audience, usually the author
+	Except uuid.UUID `json:"except,omitempty"`
+	// Users are the recipients of an AudienceUsers
+	Users []uuid.UUID `json:"users,omitempty"`
+	// Of is the user whose followers an AudienceFollowers is
+	Of uuid.UUID `json:"of,omitempty"`
+}
+
+// audience kinds
+const (
+	AudienceEveryone  = "everyone"
+	AudienceUsers     = "users"
+	AudienceFollowers = "followers"
+)
+
+var errUnknownAudience = errors.New("unknown audience")
+
+// everyoneBut is everyone except the user uid
+func everyoneBut(uid uuid.UUID) Audience {
+	return Audience{Kind: AudienceEveryone, Except: uid}
+}
+
+// followersOf is the followers of the user uid, never uid itself
+func followersOf(uid uuid.UUID) Audience {
+	return Audience{Kind: AudienceFollowers, Of: uid, Except: uid}
+}
+
+// mentionPattern finds mentions like @ann or @ann.lee in a text
+var mentionPattern = regexp.MustCompile(
+	`@([\p{L}\p{N}_]+(?:[.-][\p{L}\p{N}_]+)*)`)
+
+// maxMentions is how many mentions of a post are notified
+const maxMentions = 10
+
+// mentioned returns the users text mentions by name
+func (app *App) mentioned(ctx context.Context, text string) ([]uuid.UUID,
+	error) {
+
+	uids := []uuid.UUID{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, maxMentions) {
+		u, err := app.db.GetUserByName(ctx, m[1])
+		switch err {
+		case nil:
+			uids = append(uids, u.ID)
+		case ErrNoSuchEntity:
+		default:
+			return nil, err
+		}
+	}
+	return uids, nil
+}
+
+// resolveAudience returns the subscriptions of all users in a
+func (app *App) resolveAudience(ctx context.Context, a Audience) (
+	[]Subscription, error) {
+
+	switch a.Kind {
+	// tasks from before audiences had none
+	case AudienceEveryone, "":
+		all, err := app.db.ReadAllSubscriptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ss := []Subscription{}
+		for _, s := range all {
+			if s.UserID != a.Except {
+				ss = append(ss, s)
+			}
+		}
+		return ss, nil
+	case AudienceUsers:
+		return app.subscriptionsOf(ctx, a.Users, a.Except)
+	case AudienceFollowers:
+		uids, err := app.db.ReadFollowers(ctx, a.Of)
+		if err != nil {
+			return nil, fmt.Errorf("could not read followers of %v (%v)", a.Of,
+				err)
+		}
+		return app.subscriptionsOf(ctx, uids, a.Except)
+	default:
+		return nil, errUnknownAudience
+	}
+}
+
+// subscriptionsOf returns the subscriptions of the users uids but except
+func (app *App) subscriptionsOf(ctx context.Context, uids []uuid.UUID,
+	except uuid.UUID) ([]Subscription, error) {
+
+	ss := []Subscription{}
+	seen := map[uuid.UUID]bool{except: true}
+	for _, uid := range uids {
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		us, err := app.db.ReadSubscriptions(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, us...)
+	}
+	return ss, nil
+}
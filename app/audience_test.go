@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestResolveAudience(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+	app := &App{db: db}
+
+	author, follower, other := uuid.New(), uuid.New(), uuid.New()
+	for _, uid := range []uuid.UUID{author, follower, other} {
+		err := db.CreateSubscription(ctx, Subscription{UserID: uid,
+			Endpoint: "https://push.example.com/" + uid.String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Follow(ctx, follower, author); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		audience Audience
+		want     []uuid.UUID
+	}{
+		"everyone":  {everyoneBut(author), []uuid.UUID{follower, other}},
+		"followers": {followersOf(author), []uuid.UUID{follower}},
+		"users": {Audience{Kind: AudienceUsers, Except: author,
+			Users: []uuid.UUID{author, other, other}}, []uuid.UUID{other}},
+	}
+	for name, tt := range tests {
+		ss, err := app.resolveAudience(ctx, tt.audience)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		got := map[uuid.UUID]bool{}
+		for _, s := range ss {
+			got[s.UserID] = true
+		}
+		if len(ss) != len(tt.want) {
+			t.Errorf("%v: got %d subscriptions, want %d", name, len(ss),
+				len(tt.want))
+		}
+		for _, uid := range tt.want {
+			if !got[uid] {
+				t.Errorf("%v: %v is missing", name, uid)
+			}
+		}
+	}
+
+	_, err := app.resolveAudience(ctx, Audience{Kind: "nobody"})
+	if err != errUnknownAudience {
+		t.Errorf("got %v for an unknown kind, want %v", err, errUnknownAudience)
+	}
+}
+
+func TestMentioned(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+	app := &App{db: db}
+
+	ann := User{ID: uuid.New(), Name: "Ann.Lee"}
+	bob := User{ID: uuid.New(), Name: "bob"}
+	for _, u := range []User{ann, bob} {
+		if err := db.CreateUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string][]uuid.UUID{
+		"no one":                   {},
+		"hi @bob":                  {bob.ID},
+		"@ann.lee, @BOB.":          {ann.ID, bob.ID},
+		"mail bob@example.com":     {},
+		"@nobody and @bob-builder": {},
+	}
+	for text, want := range tests {
+		got, err := app.mentioned(ctx, text)
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%q: got %v, want %v", text, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%q: got %v, want %v", text, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// postCursor is the position of a post in the newest first order, used as a
+// keyset cursor by the memory and SQL backends
+type postCursor struct {
+	ms int64
+	id uuid.UUID
+}
+
+func cursorOf(p Post) postCursor {
+	return postCursor{p.Time.toMillis(), p.ID}
+}
+
+// precedes reports whether p comes after the cursor in newest first order
+func (c postCursor) precedes(p Post) bool {
+	ms := p.Time.toMillis()
+	if ms == c.ms {
+		return p.ID.String() < c.id.String()
+	}
+	return ms < c.ms
+}
+
+func (c postCursor) String() string {
+	s := fmt.Sprintf("%d:%s", c.ms, c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parsePostCursor(s string) (postCursor, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return postCursor{}, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(bs), ":", 2)
+	if len(parts) != 2 {
+		return postCursor{}, ErrInvalidCursor
+	}
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return postCursor{}, ErrInvalidCursor
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return postCursor{}, ErrInvalidCursor
+	}
+	return postCursor{ms, id}, nil
+}
@@ -3,23 +3,116 @@ package app
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 var (
-	ErrNoSuchEntity = errors.New("Not such entity in database")
+	ErrNoSuchEntity  = errors.New("Not such entity in database")
+	ErrEntityExists  = errors.New("Entity already exists in database")
+	ErrInvalidCursor = errors.New("Invalid cursor")
+	ErrNameTaken     = errors.New("User name is taken")
+	ErrStaleSession  = errors.New("Session was revoked or changed")
 )
 
 type DB interface {
 	GetUser(context.Context, uuid.UUID) (User, error)
 	GetUsers(context.Context) ([]User, error)
+	// GetUserByName finds a user by name, ignoring case
+	GetUserByName(context.Context, string) (User, error)
+	// CreateUser stores a new user. It fails with ErrEntityExists if the ID
+	// is used and with ErrNameTaken if another user has the same name, as
+	// compared by NormalizeName.
+	CreateUser(context.Context, User) error
+	// PutUser creates or replaces a user, it fails with ErrNameTaken like
+	// CreateUser
 	PutUser(context.Context, User) error
+	// UpdateUser changes a user with f in a transaction, unless f fails, and
+	// returns the changed user. f might run more than once. It fails with
+	// ErrNameTaken like CreateUser.
+	UpdateUser(ctx context.Context, id uuid.UUID, f func(*User) error) (User,
+		error)
+	// CreateSubscription stores a subscription keyed by its endpoint, so a
+	// browser subscribing again replaces its earlier subscription
 	CreateSubscription(context.Context, Subscription) error
-	ReadSubscription(context.Context, uuid.UUID) (Subscription, error)
+	// GetSubscription finds the subscription with the given endpoint
+	GetSubscription(context.Context, string) (Subscription, error)
+	// ReadSubscriptions returns the subscriptions of a user, one per device
+	ReadSubscriptions(context.Context, uuid.UUID) ([]Subscription, error)
 	ReadAllSubscriptions(context.Context) ([]Subscription, error)
+	// DeleteSubscription removes the subscription with the given endpoint
+	// and records a SubscriptionRemoval with the given reason
+	DeleteSubscription(ctx context.Context, endpoint, reason string) error
+	// ReadSubscriptionRemovals returns the removed subscriptions of a user,
+	// newest first
+	ReadSubscriptionRemovals(context.Context, uuid.UUID) ([]SubscriptionRemoval, error)
 	GetKey(context.Context) (KeyPair, error)
 	PutKey(context.Context, KeyPair) error
-	ReadPosts(context.Context) ([]Post, error)
+	// Posts only keep the ID of their user, the DB returns them with the
+	// other User fields empty.
+	//
+	// ReadPosts returns up to limit posts, newest first, starting after the
+	// given cursor ("" for the newest post). Deleted posts are left out. The
+	// returned cursor is opaque and empty when there are no more posts.
+	ReadPosts(ctx context.Context, cursor string, limit int) ([]Post, string, error)
+	// ReadPostChanges returns up to limit posts, including deleted ones,
+	// with a Version greater than since, ordered by Version.
+	ReadPostChanges(ctx context.Context, since int64, limit int) ([]Post, error)
+	GetPost(context.Context, uuid.UUID) (Post, error)
+	// CreatePost stores a new post and assigns it the next Version. If a post
+	// with the same ID exists it is left alone and returned together with
+	// ErrEntityExists.
+	CreatePost(context.Context, Post) (Post, error)
+	// PutPost creates or replaces a post and assigns it the next Version.
 	PutPost(context.Context, Post) error
+	CreateSession(context.Context, Session) error
+	GetSession(context.Context, uuid.UUID) (Session, error)
+	// TouchSession sets when a session was last used. It returns
+	// ErrStaleSession if the session is revoked.
+	TouchSession(ctx context.Context, id uuid.UUID, lastSeen time.Time) error
+	// RotateRefresh replaces the refresh hash of a session if it still is
+	// oldHash, and sets when it was last used. It returns ErrStaleSession if
+	// the session is revoked or has another hash.
+	RotateRefresh(ctx context.Context, id uuid.UUID, oldHash, newHash string,
+		lastSeen time.Time) error
+	RevokeSession(context.Context, uuid.UUID) error
+	// ReadSessions returns all sessions of a user, including revoked and
+	// expired ones
+	ReadSessions(context.Context, uuid.UUID) ([]Session, error)
+	// DeleteSessionSubscriptions removes the subscriptions made in a session,
+	// recording them as removed with RemovalSessionEnded
+	DeleteSessionSubscriptions(context.Context, uuid.UUID) error
+	GetCredential(context.Context, uuid.UUID) (Credential, error)
+	PutCredential(context.Context, Credential) error
+	// GetIdentity finds the link of an identity provider account to a user
+	GetIdentity(ctx context.Context, issuer, subject string) (Identity, error)
+	CreateIdentity(context.Context, Identity) error
+	PutAvatar(context.Context, Avatar) error
+	GetAvatar(ctx context.Context, id uuid.UUID, size int) (Avatar, error)
+	// DeleteAvatar removes all sizes of an avatar
+	DeleteAvatar(context.Context, uuid.UUID) error
+	// PutTask creates or replaces a task of a LocalTasks queue
+	PutTask(context.Context, Task) error
+	// ReadDueTasks returns up to limit tasks that are due at now, the
+	// longest due first
+	ReadDueTasks(ctx context.Context, now time.Time, limit int) ([]Task, error)
+	// DeleteTask removes a task, tasks that are gone already are no error
+	DeleteTask(context.Context, uuid.UUID) error
+	CreateDeadLetter(context.Context, DeadLetter) error
+	// ReadDeadLetters returns up to limit dead letters, newest first
+	ReadDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+	// Follow makes follower a follower of followee, following twice is no
+	// error
+	Follow(ctx context.Context, follower, followee uuid.UUID) error
+	// Unfollow ends following, it is no error if there was none
+	Unfollow(ctx context.Context, follower, followee uuid.UUID) error
+	// ReadFollowers returns the IDs of the users following a user
+	ReadFollowers(context.Context, uuid.UUID) ([]uuid.UUID, error)
+	// ReadFollowing returns the IDs of the users a user follows
+	ReadFollowing(context.Context, uuid.UUID) ([]uuid.UUID, error)
+	// GetNotificationSettings returns ErrNoSuchEntity for users who never
+	// saved theirs
+	GetNotificationSettings(context.Context, uuid.UUID) (NotificationSettings, error)
+	PutNotificationSettings(context.Context, NotificationSettings) error
 }
@@ -0,0 +1,1188 @@
+// Package dbtest is a conformance test suite for app.DB implementations.
+//
+// A backend runs it from its own tests:
+//
+//	func TestMyDB(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) app.DB {
+//			return newEmptyMyDB(t)
+//		})
+//	}
+//
+// newDB is called once per subtest and must return an empty database.
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/maxhille/elm-pwa-example/app"
+)
+
+type test struct {
+	name string
+	run  func(*testing.T, app.DB)
+}
+
+var tests = []test{
+	{"UserRoundTrip", testUserRoundTrip},
+	{"GetUsers", testGetUsers},
+	{"GetUserByName", testGetUserByName},
+	{"UniqueNames", testUniqueNames},
+	{"ConcurrentNames", testConcurrentNames},
+	{"UpdateUser", testUpdateUser},
+	{"KeyRoundTrip", testKeyRoundTrip},
+	{"SubscriptionRoundTrip", testSubscriptionRoundTrip},
+	{"SubscriptionsOfOneUser", testSubscriptionsOfOneUser},
+	{"SubscriptionsOfManyUsers", testSubscriptionsOfManyUsers},
+	{"DeleteSubscription", testDeleteSubscription},
+	{"PostRoundTrip", testPostRoundTrip},
+	{"PostOrder", testPostOrder},
+	{"PostPages", testPostPages},
+	{"InvalidCursor", testInvalidCursor},
+	{"CreatePost", testCreatePost},
+	{"PostChanges", testPostChanges},
+	{"DeletedPosts", testDeletedPosts},
+	{"SessionRoundTrip", testSessionRoundTrip},
+	{"SessionUpdates", testSessionUpdates},
+	{"ReadSessions", testReadSessions},
+	{"DeleteSessionSubscriptions", testDeleteSessionSubscriptions},
+	{"CredentialRoundTrip", testCredentialRoundTrip},
+	{"CreateIdentity", testCreateIdentity},
+	{"AvatarRoundTrip", testAvatarRoundTrip},
+	{"DueTasks", testDueTasks},
+	{"DeadLetters", testDeadLetters},
+	{"Follows", testFollows},
+	{"NotificationSettings", testNotificationSettings},
+	{"NoSuchEntity", testNoSuchEntity},
+	{"ConcurrentWriters", testConcurrentWriters},
+}
+
+func Run(t *testing.T, newDB func(*testing.T) app.DB) {
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newDB(t))
+		})
+	}
+}
+
+func newUser(name string) app.User {
+	return app.User{ID: uuid.New(), Name: name}
+}
+
+func newPost(u app.User, text string, ms int64) app.Post {
+	return app.Post{
+		ID:   uuid.New(),
+		User: u,
+		Text: text,
+		Time: app.Time{Time: time.Unix(0, ms*int64(time.Millisecond))},
+	}
+}
+
+func testUserRoundTrip(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	u := newUser("alice")
+
+	must(t, db.PutUser(ctx, u))
+	u2, err := db.GetUser(ctx, u.ID)
+	must(t, err)
+	if u2 != u {
+		t.Errorf("got user %+v, want %+v", u2, u)
+	}
+
+	u.Name = "alice2"
+	u.DisplayName = "Alice"
+	u.Bio = "likes cryptography"
+	u.Avatar = uuid.New().String()
+	must(t, db.PutUser(ctx, u))
+	u2, err = db.GetUser(ctx, u.ID)
+	must(t, err)
+	if u2 != u {
+		t.Errorf("after update got user %+v, want %+v", u2, u)
+	}
+}
+
+func testGetUsers(t *testing.T, db app.DB) {
+	ctx := context.Background()
+
+	us, err := db.GetUsers(ctx)
+	must(t, err)
+	if len(us) != 0 {
+		t.Errorf("got %d users from empty db, want 0", len(us))
+	}
+
+	want := map[uuid.UUID]app.User{}
+	for i := 0; i < 3; i++ {
+		u := newUser(fmt.Sprintf("user%d", i))
+		must(t, db.PutUser(ctx, u))
+		want[u.ID] = u
+	}
+
+	us, err = db.GetUsers(ctx)
+	must(t, err)
+	if len(us) != len(want) {
+		t.Fatalf("got %d users, want %d", len(us), len(want))
+	}
+	for _, u := range us {
+		if want[u.ID] != u {
+			t.Errorf("got unexpected user %+v", u)
+		}
+	}
+}
+
+func testGetUserByName(t *testing.T, db app.DB) {
+	ctx := context.Background()
+
+	u := newUser("bob")
+	must(t, db.PutUser(ctx, u))
+	must(t, db.PutUser(ctx, newUser("carol")))
+
+	for _, name := range []string{"bob", "BOB", " Bob "} {
+		u2, err := db.GetUserByName(ctx, name)
+		must(t, err)
+		if u2 != u {
+			t.Errorf("got user %+v for %q, want %+v", u2, name, u)
+		}
+	}
+
+	_, err := db.GetUserByName(ctx, "dave")
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v for unknown name, want ErrNoSuchEntity", err)
+	}
+}
+
+func testUniqueNames(t *testing.T, db app.DB) {
+	ctx := context.Background()
+
+	alice := newUser("Alice")
+	must(t, db.CreateUser(ctx, alice))
+	err := db.CreateUser(ctx, alice)
+	if err != app.ErrEntityExists {
+		t.Errorf("got error %v for existing user, want ErrEntityExists", err)
+	}
+	err = db.CreateUser(ctx, newUser("aLICE"))
+	if err != app.ErrNameTaken {
+		t.Errorf("got error %v for taken name, want ErrNameTaken", err)
+	}
+
+	bob := newUser("bob")
+	must(t, db.CreateUser(ctx, bob))
+	bob.Name = "alice"
+	err = db.PutUser(ctx, bob)
+	if err != app.ErrNameTaken {
+		t.Errorf("got error %v for rename to taken name, want ErrNameTaken",
+			err)
+	}
+
+	// renaming frees the old name
+	alice.Name = "Alicia"
+	must(t, db.PutUser(ctx, alice))
+	carol := newUser("alice")
+	must(t, db.CreateUser(ctx, carol))
+	u, err := db.GetUserByName(ctx, "ALICE")
+	must(t, err)
+	if u != carol {
+		t.Errorf("got user %+v, want %+v", u, carol)
+	}
+	u, err = db.GetUserByName(ctx, "alicia")
+	must(t, err)
+	if u != alice {
+		t.Errorf("got user %+v, want %+v", u, alice)
+	}
+}
+
+func testConcurrentNames(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	const n = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.CreateUser(ctx, newUser("alice"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			created++
+		case app.ErrNameTaken:
+		default:
+			t.Errorf("got error %v, want nil or ErrNameTaken", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("created %d users with the same name, want 1", created)
+	}
+}
+
+func testUpdateUser(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	alice := newUser("alice")
+	must(t, db.CreateUser(ctx, alice))
+	must(t, db.CreateUser(ctx, newUser("bob")))
+
+	// every update sees the ones before
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.UpdateUser(ctx, alice.ID, func(u *app.User) error {
+				u.Bio += "x"
+				return nil
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		must(t, err)
+	}
+	u, err := db.GetUser(ctx, alice.ID)
+	must(t, err)
+	if len(u.Bio) != n {
+		t.Errorf("got bio %q after %d updates", u.Bio, n)
+	}
+
+	u, err = db.UpdateUser(ctx, alice.ID, func(u *app.User) error {
+		u.DisplayName = "Alice"
+		return nil
+	})
+	must(t, err)
+	if u.ID != alice.ID || u.DisplayName != "Alice" {
+		t.Errorf("got user %+v after update", u)
+	}
+
+	failed := errors.New("failed")
+	_, err = db.UpdateUser(ctx, alice.ID, func(u *app.User) error {
+		u.DisplayName = "Eve"
+		return failed
+	})
+	if err != failed {
+		t.Errorf("got error %v from a failing update, want %v", err, failed)
+	}
+	_, err = db.UpdateUser(ctx, alice.ID, func(u *app.User) error {
+		u.Name = "BOB"
+		return nil
+	})
+	if err != app.ErrNameTaken {
+		t.Errorf("got error %v for rename to taken name, want ErrNameTaken",
+			err)
+	}
+	u, err = db.GetUser(ctx, alice.ID)
+	must(t, err)
+	if u.Name != "alice" || u.DisplayName != "Alice" {
+		t.Errorf("failed updates changed the user to %+v", u)
+	}
+
+	_, err = db.UpdateUser(ctx, uuid.New(), func(u *app.User) error {
+		return nil
+	})
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v for unknown user, want ErrNoSuchEntity", err)
+	}
+}
+
+func testKeyRoundTrip(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	kp := app.KeyPair{PK: "public", SK: "secret"}
+
+	must(t, db.PutKey(ctx, kp))
+	kp2, err := db.GetKey(ctx)
+	must(t, err)
+	if kp2 != kp {
+		t.Errorf("got key %+v, want %+v", kp2, kp)
+	}
+
+	kp.PK = "public2"
+	must(t, db.PutKey(ctx, kp))
+	kp2, err = db.GetKey(ctx)
+	must(t, err)
+	if kp2 != kp {
+		t.Errorf("after update got key %+v, want %+v", kp2, kp)
+	}
+}
+
+func testSubscriptionRoundTrip(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	s := app.Subscription{
+		UserID:    uuid.New(),
+		SessionID: uuid.New(),
+		Endpoint:  "https://push.example.com/1",
+		P256dh:    "p256dh",
+		Auth:      "auth",
+	}
+
+	must(t, db.CreateSubscription(ctx, s))
+	s2, err := db.GetSubscription(ctx, s.Endpoint)
+	must(t, err)
+	if s2 != s {
+		t.Errorf("got subscription %+v, want %+v", s2, s)
+	}
+
+	// the same browser subscribing again, now for another user
+	s.UserID = uuid.New()
+	s.Auth = "auth2"
+	must(t, db.CreateSubscription(ctx, s))
+	s2, err = db.GetSubscription(ctx, s.Endpoint)
+	must(t, err)
+	if s2 != s {
+		t.Errorf("after update got subscription %+v, want %+v", s2, s)
+	}
+	ss, err := db.ReadAllSubscriptions(ctx)
+	must(t, err)
+	if len(ss) != 1 {
+		t.Errorf("got %d subscriptions after update, want 1", len(ss))
+	}
+}
+
+func testSubscriptionsOfOneUser(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	uid := uuid.New()
+
+	want := map[string]app.Subscription{}
+	for i := 0; i < 3; i++ {
+		s := app.Subscription{
+			UserID:   uid,
+			Endpoint: fmt.Sprintf("https://push.example.com/%d", i),
+		}
+		must(t, db.CreateSubscription(ctx, s))
+		want[s.Endpoint] = s
+	}
+	must(t, db.CreateSubscription(ctx, app.Subscription{
+		UserID:   uuid.New(),
+		Endpoint: "https://push.example.com/other",
+	}))
+
+	ss, err := db.ReadSubscriptions(ctx, uid)
+	must(t, err)
+	if len(ss) != len(want) {
+		t.Fatalf("got %d subscriptions, want %d", len(ss), len(want))
+	}
+	for _, s := range ss {
+		if want[s.Endpoint] != s {
+			t.Errorf("got unexpected subscription %+v", s)
+		}
+	}
+}
+
+func testSubscriptionsOfManyUsers(t *testing.T, db app.DB) {
+	ctx := context.Background()
+
+	want := map[string]app.Subscription{}
+	for i := 0; i < 3; i++ {
+		s := app.Subscription{
+			UserID:   uuid.New(),
+			Endpoint: fmt.Sprintf("https://push.example.com/%d", i),
+			P256dh:   "p256dh",
+			Auth:     "auth",
+		}
+		must(t, db.CreateSubscription(ctx, s))
+		want[s.Endpoint] = s
+	}
+
+	ss, err := db.ReadAllSubscriptions(ctx)
+	must(t, err)
+	if len(ss) != len(want) {
+		t.Fatalf("got %d subscriptions, want %d", len(ss), len(want))
+	}
+	for _, s := range ss {
+		if want[s.Endpoint] != s {
+			t.Errorf("got unexpected subscription %+v", s)
+		}
+	}
+}
+
+func testPostRoundTrip(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	u := newUser("alice")
+	must(t, db.PutUser(ctx, u))
+	p := newPost(u, "hello", 1000)
+
+	must(t, db.PutPost(ctx, p))
+	ps := readPosts(t, db)
+	if len(ps) != 1 {
+		t.Fatalf("got %d posts, want 1", len(ps))
+	}
+	assertPost(t, ps[0], p)
+
+	p.Text = "edited"
+	p.Edited = &app.Time{Time: time.Unix(2, 0)}
+	must(t, db.PutPost(ctx, p))
+	p2, err := db.GetPost(ctx, p.ID)
+	must(t, err)
+	assertPost(t, p2, p)
+}
+
+func testPostOrder(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	u := newUser("alice")
+	must(t, db.PutUser(ctx, u))
+
+	// insertion order deliberately differs from time order
+	for _, ms := range []int64{2000, 1000, 4000, 3000, 3000} {
+		must(t, db.PutPost(ctx, newPost(u, "post", ms)))
+	}
+
+	ps := readPosts(t, db)
+	if len(ps) != 5 {
+		t.Fatalf("got %d posts, want 5", len(ps))
+	}
+	for i := 1; i < len(ps); i++ {
+		if ps[i].Time.After(ps[i-1].Time.Time) {
+			t.Errorf("post %d (%v) is newer than post %d (%v)", i,
+				ps[i].Time, i-1, ps[i-1].Time)
+		}
+	}
+}
+
+func testPostPages(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	u := newUser("alice")
+	must(t, db.PutUser(ctx, u))
+
+	// two posts share a time to check the order is total
+	want := []app.Post{}
+	for _, ms := range []int64{7000, 6000, 5000, 5000, 4000, 3000, 2000} {
+		p := newPost(u, "post", ms)
+		must(t, db.PutPost(ctx, p))
+		want = append(want, p)
+	}
+	all := readPosts(t, db)
+
+	got := []app.Post{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatalf("cursor never ran out after %d pages", pages)
+		}
+		ps, next, err := db.ReadPosts(ctx, cursor, 3)
+		must(t, err)
+		if len(ps) > 3 {
+			t.Fatalf("got page of %d posts, want at most 3", len(ps))
+		}
+		got = append(got, ps...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d posts over all pages, want %d", len(got), len(want))
+	}
+	for i := range got {
+		assertPost(t, got[i], all[i])
+	}
+}
+
+func testInvalidCursor(t *testing.T, db app.DB) {
+	_, _, err := db.ReadPosts(context.Background(), "not a cursor", 10)
+	if err != app.ErrInvalidCursor {
+		t.Errorf("got error %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testCreatePost(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	u := newUser("alice")
+	must(t, db.PutUser(ctx, u))
+	p := newPost(u, "original", 1000)
+
+	p2, err := db.CreatePost(ctx, p)
+	must(t, err)
+	assertPost(t, p2, p)
+	p3, err := db.GetPost(ctx, p.ID)
+	must(t, err)
+	assertPost(t, p3, p)
+
+	// a second create with the same ID must not change anything
+	retry := p
+	retry.Text = "retry"
+	retry.User = newUser("mallory")
+	p4, err := db.CreatePost(ctx, retry)
+	if err != app.ErrEntityExists {
+		t.Errorf("got error %v for existing ID, want ErrEntityExists", err)
+	}
+	assertPost(t, p4, p)
+	if p4.Version != p2.Version {
+		t.Errorf("got version %d after repeated create, want %d", p4.Version,
+			p2.Version)
+	}
+	ps := readPosts(t, db)
+	if len(ps) != 1 {
+		t.Fatalf("got %d posts, want 1", len(ps))
+	}
+	assertPost(t, ps[0], p)
+
+	_, err = db.GetPost(ctx, uuid.New())
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v for unknown post, want ErrNoSuchEntity", err)
+	}
+}
+
+func testPostChanges(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	u := newUser("alice")
+	must(t, db.PutUser(ctx, u))
+
+	ps := []app.Post{}
+	for i := int64(1); i <= 3; i++ {
+		p := newPost(u, "post", i*1000)
+		must(t, db.PutPost(ctx, p))
+		ps = append(ps, p)
+	}
+
+	cs, err := db.ReadPostChanges(ctx, 0, 100)
+	must(t, err)
+	if len(cs) != 3 {
+		t.Fatalf("got %d changes since 0, want 3", len(cs))
+	}
+	for i := range cs {
+		assertPost(t, cs[i], ps[i])
+		if i > 0 && cs[i].Version != cs[i-1].Version+1 {
+			t.Errorf("version %d of change %d does not follow %d",
+				cs[i].Version, i, cs[i-1].Version)
+		}
+	}
+
+	// an edit moves the post behind all others
+	first := cs[0].Version
+	ps[0].Text = "edited"
+	must(t, db.PutPost(ctx, ps[0]))
+	cs2, err := db.ReadPostChanges(ctx, first, 100)
+	must(t, err)
+	if len(cs2) != 3 {
+		t.Fatalf("got %d changes since %d, want 3", len(cs2), first)
+	}
+	assertPost(t, cs2[2], ps[0])
+	if cs2[2].Version != cs[2].Version+1 {
+		t.Errorf("edit got version %d, want %d", cs2[2].Version,
+			cs[2].Version+1)
+	}
+
+	cs3, err := db.ReadPostChanges(ctx, first, 1)
+	must(t, err)
+	if len(cs3) != 1 || cs3[0].ID != ps[1].ID {
+		t.Errorf("got changes %+v with limit 1, want only %v", cs3, ps[1].ID)
+	}
+
+	cs4, err := db.ReadPostChanges(ctx, cs2[2].Version, 100)
+	must(t, err)
+	if len(cs4) != 0 {
+		t.Errorf("got %d changes since the latest version, want 0", len(cs4))
+	}
+}
+
+func testDeletedPosts(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	u := newUser("alice")
+	must(t, db.PutUser(ctx, u))
+
+	p := newPost(u, "gone soon", 1000)
+	must(t, db.PutPost(ctx, p))
+	must(t, db.PutPost(ctx, newPost(u, "stays", 2000)))
+	p.Deleted = true
+	must(t, db.PutPost(ctx, p))
+
+	ps := readPosts(t, db)
+	if len(ps) != 1 || ps[0].ID == p.ID {
+		t.Errorf("got posts %+v, want only the one not deleted", ps)
+	}
+
+	cs, err := db.ReadPostChanges(ctx, 0, 100)
+	must(t, err)
+	if len(cs) != 2 {
+		t.Fatalf("got %d changes, want 2", len(cs))
+	}
+	if cs[1].ID != p.ID || !cs[1].Deleted {
+		t.Errorf("got last change %+v, want tombstone of %v", cs[1], p.ID)
+	}
+}
+
+func testSessionRoundTrip(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	s := app.Session{
+		ID:          uuid.New(),
+		UserID:      uuid.New(),
+		RefreshHash: "hash",
+		Device:      "Mozilla/5.0",
+		Created:     app.Time{Time: time.Unix(1, 0)},
+		LastSeen:    app.Time{Time: time.Unix(1, 0)},
+		Expires:     app.Time{Time: time.Unix(2, 0)},
+	}
+
+	must(t, db.CreateSession(ctx, s))
+	s2, err := db.GetSession(ctx, s.ID)
+	must(t, err)
+	assertSession(t, s2, s)
+
+	err = db.CreateSession(ctx, s)
+	if err != app.ErrEntityExists {
+		t.Errorf("got error %v for existing session, want ErrEntityExists",
+			err)
+	}
+
+}
+
+func testSessionUpdates(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	s := app.Session{
+		ID:          uuid.New(),
+		UserID:      uuid.New(),
+		RefreshHash: "hash",
+		Created:     app.Time{Time: time.Unix(1, 0)},
+		LastSeen:    app.Time{Time: time.Unix(1, 0)},
+		Expires:     app.Time{Time: time.Unix(9, 0)},
+	}
+	must(t, db.CreateSession(ctx, s))
+	assertStored := func() {
+		t.Helper()
+		got, err := db.GetSession(ctx, s.ID)
+		must(t, err)
+		assertSession(t, got, s)
+	}
+
+	s.LastSeen = app.Time{Time: time.Unix(2, 0)}
+	must(t, db.TouchSession(ctx, s.ID, s.LastSeen.Time))
+	assertStored()
+
+	err := db.RotateRefresh(ctx, s.ID, "other", "hash2", time.Unix(3, 0))
+	if err != app.ErrStaleSession {
+		t.Errorf("RotateRefresh from another hash: got error %v, want "+
+			"ErrStaleSession", err)
+	}
+	assertStored()
+	s.RefreshHash = "hash2"
+	s.LastSeen = app.Time{Time: time.Unix(3, 0)}
+	must(t, db.RotateRefresh(ctx, s.ID, "hash", "hash2", s.LastSeen.Time))
+	assertStored()
+
+	// revoked sessions stay revoked
+	must(t, db.RevokeSession(ctx, s.ID))
+	s.Revoked = true
+	assertStored()
+	err = db.TouchSession(ctx, s.ID, time.Unix(4, 0))
+	if err != app.ErrStaleSession {
+		t.Errorf("TouchSession of revoked session: got error %v, want "+
+			"ErrStaleSession", err)
+	}
+	err = db.RotateRefresh(ctx, s.ID, "hash2", "hash3", time.Unix(4, 0))
+	if err != app.ErrStaleSession {
+		t.Errorf("RotateRefresh of revoked session: got error %v, want "+
+			"ErrStaleSession", err)
+	}
+	assertStored()
+}
+
+func testReadSessions(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	uid := uuid.New()
+	want := map[uuid.UUID]app.Session{}
+	for i := 0; i < 3; i++ {
+		s := app.Session{
+			ID:       uuid.New(),
+			UserID:   uid,
+			Created:  app.Time{Time: time.Unix(int64(i), 0)},
+			LastSeen: app.Time{Time: time.Unix(int64(i), 0)},
+			Expires:  app.Time{Time: time.Unix(int64(i), 0)},
+		}
+		must(t, db.CreateSession(ctx, s))
+		want[s.ID] = s
+	}
+	must(t, db.CreateSession(ctx, app.Session{ID: uuid.New(), UserID: uuid.New()}))
+
+	ss, err := db.ReadSessions(ctx, uid)
+	must(t, err)
+	if len(ss) != len(want) {
+		t.Fatalf("got %d sessions, want %d", len(ss), len(want))
+	}
+	for _, s := range ss {
+		assertSession(t, s, want[s.ID])
+	}
+}
+
+func testDeleteSessionSubscriptions(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	sid := uuid.New()
+	gone := app.Subscription{UserID: uuid.New(), SessionID: sid, Endpoint: "a"}
+	kept := app.Subscription{UserID: uuid.New(), SessionID: uuid.New(),
+		Endpoint: "b"}
+	must(t, db.CreateSubscription(ctx, gone))
+	must(t, db.CreateSubscription(ctx, kept))
+
+	must(t, db.DeleteSessionSubscriptions(ctx, sid))
+
+	_, err := db.GetSubscription(ctx, gone.Endpoint)
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v for subscription of deleted session, want "+
+			"ErrNoSuchEntity", err)
+	}
+	s, err := db.GetSubscription(ctx, kept.Endpoint)
+	must(t, err)
+	if s != kept {
+		t.Errorf("got subscription %+v, want %+v", s, kept)
+	}
+	rs, err := db.ReadSubscriptionRemovals(ctx, gone.UserID)
+	must(t, err)
+	if len(rs) != 1 || rs[0].Reason != app.RemovalSessionEnded {
+		t.Errorf("got removals %+v, want one with reason %v", rs,
+			app.RemovalSessionEnded)
+	}
+}
+
+func testDeleteSubscription(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	uid := uuid.New()
+	first := app.Subscription{UserID: uid, SessionID: uuid.New(),
+		Endpoint: "https://push.example.com/1"}
+	second := app.Subscription{UserID: uid, SessionID: uuid.New(),
+		Endpoint: "https://push.example.com/2"}
+	other := app.Subscription{UserID: uuid.New(), SessionID: uuid.New(),
+		Endpoint: "https://push.example.com/3"}
+	for _, s := range []app.Subscription{first, second, other} {
+		must(t, db.CreateSubscription(ctx, s))
+	}
+
+	must(t, db.DeleteSubscription(ctx, first.Endpoint, app.RemovalExpired))
+	// removals are ordered by time, make sure the second one comes later
+	time.Sleep(2 * time.Millisecond)
+	must(t, db.DeleteSubscription(ctx, second.Endpoint,
+		app.RemovalUnsubscribed))
+
+	_, err := db.GetSubscription(ctx, first.Endpoint)
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v for deleted subscription, want "+
+			"ErrNoSuchEntity", err)
+	}
+	err = db.DeleteSubscription(ctx, first.Endpoint, app.RemovalExpired)
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v deleting twice, want ErrNoSuchEntity", err)
+	}
+	ss, err := db.ReadSubscriptions(ctx, uid)
+	must(t, err)
+	if len(ss) != 0 {
+		t.Errorf("got %d subscriptions, want none", len(ss))
+	}
+
+	rs, err := db.ReadSubscriptionRemovals(ctx, uid)
+	must(t, err)
+	want := []struct{ endpoint, reason string }{
+		{second.Endpoint, app.RemovalUnsubscribed},
+		{first.Endpoint, app.RemovalExpired},
+	}
+	if len(rs) != len(want) {
+		t.Fatalf("got %d removals, want %d", len(rs), len(want))
+	}
+	for i, w := range want {
+		r := rs[i]
+		if r.UserID != uid || r.Endpoint != w.endpoint ||
+			r.Reason != w.reason || r.Time.IsZero() {
+			t.Errorf("removal %d: got %+v, want %v with reason %v", i, r,
+				w.endpoint, w.reason)
+		}
+	}
+
+	rs, err = db.ReadSubscriptionRemovals(ctx, other.UserID)
+	must(t, err)
+	if len(rs) != 0 {
+		t.Errorf("got removals %+v for other user, want none", rs)
+	}
+}
+
+func testCredentialRoundTrip(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	c := app.Credential{UserID: uuid.New(), PasswordHash: "hash"}
+
+	must(t, db.PutCredential(ctx, c))
+	c2, err := db.GetCredential(ctx, c.UserID)
+	must(t, err)
+	if c2 != c {
+		t.Errorf("got credential %+v, want %+v", c2, c)
+	}
+
+	c.PasswordHash = "hash2"
+	must(t, db.PutCredential(ctx, c))
+	c2, err = db.GetCredential(ctx, c.UserID)
+	must(t, err)
+	if c2 != c {
+		t.Errorf("got credential %+v, want %+v", c2, c)
+	}
+}
+
+func testCreateIdentity(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	id := app.Identity{
+		Issuer:  "https://idp.example",
+		Subject: "1234",
+		UserID:  uuid.New(),
+	}
+
+	must(t, db.CreateIdentity(ctx, id))
+	id2, err := db.GetIdentity(ctx, id.Issuer, id.Subject)
+	must(t, err)
+	if id2 != id {
+		t.Errorf("got identity %+v, want %+v", id2, id)
+	}
+
+	other := id
+	other.UserID = uuid.New()
+	err = db.CreateIdentity(ctx, other)
+	if err != app.ErrEntityExists {
+		t.Errorf("got error %v for existing identity, want ErrEntityExists",
+			err)
+	}
+	id2, err = db.GetIdentity(ctx, id.Issuer, id.Subject)
+	must(t, err)
+	if id2 != id {
+		t.Errorf("got identity %+v after conflict, want %+v", id2, id)
+	}
+
+	_, err = db.GetIdentity(ctx, "https://other.example", id.Subject)
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v for other issuer, want ErrNoSuchEntity", err)
+	}
+}
+
+func testAvatarRoundTrip(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	id := uuid.New()
+	small := app.Avatar{ID: id, Size: 64, PNG: []byte("small")}
+	large := app.Avatar{ID: id, Size: 256, PNG: []byte("large")}
+	other := app.Avatar{ID: uuid.New(), Size: 64, PNG: []byte("other")}
+	for _, a := range []app.Avatar{small, large, other} {
+		must(t, db.PutAvatar(ctx, a))
+	}
+
+	for _, want := range []app.Avatar{small, large} {
+		a, err := db.GetAvatar(ctx, id, want.Size)
+		must(t, err)
+		if a.ID != want.ID || a.Size != want.Size ||
+			string(a.PNG) != string(want.PNG) {
+			t.Errorf("got avatar %+v, want %+v", a, want)
+		}
+	}
+
+	must(t, db.DeleteAvatar(ctx, id))
+	_, err := db.GetAvatar(ctx, id, small.Size)
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("got error %v for deleted avatar, want ErrNoSuchEntity", err)
+	}
+	_, err = db.GetAvatar(ctx, other.ID, other.Size)
+	must(t, err)
+}
+
+func testDueTasks(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	older := app.Task{ID: uuid.New(), Kind: "a", Payload: []byte(`{"n":1}`),
+		NotBefore: app.Time{Time: now.Add(-time.Hour)}}
+	old := app.Task{ID: uuid.New(), Kind: "b",
+		NotBefore: app.Time{Time: now.Add(-time.Minute)}}
+	later := app.Task{ID: uuid.New(), Kind: "c",
+		NotBefore: app.Time{Time: now.Add(time.Minute)}}
+	for _, tk := range []app.Task{later, old, older} {
+		must(t, db.PutTask(ctx, tk))
+	}
+
+	ts, err := db.ReadDueTasks(ctx, now, 10)
+	must(t, err)
+	assertTasks(t, ts, older, old)
+	ts, err = db.ReadDueTasks(ctx, now, 1)
+	must(t, err)
+	assertTasks(t, ts, older)
+
+	// rescheduling replaces the task
+	older.NotBefore = app.Time{Time: now.Add(time.Hour)}
+	older.Attempts = 2
+	must(t, db.PutTask(ctx, older))
+	must(t, db.DeleteTask(ctx, old.ID))
+	must(t, db.DeleteTask(ctx, old.ID))
+	ts, err = db.ReadDueTasks(ctx, now.Add(2*time.Minute), 10)
+	must(t, err)
+	assertTasks(t, ts, later)
+	ts, err = db.ReadDueTasks(ctx, now.Add(2*time.Hour), 10)
+	must(t, err)
+	assertTasks(t, ts, later, older)
+}
+
+func assertTasks(t *testing.T, got []app.Task, want ...app.Task) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d tasks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.ID != w.ID || g.Kind != w.Kind ||
+			string(g.Payload) != string(w.Payload) ||
+			!g.NotBefore.Equal(w.NotBefore.Time) || g.Attempts != w.Attempts {
+			t.Errorf("task %d: got %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func testDeadLetters(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	ds := []app.DeadLetter{}
+	for i := 0; i < 3; i++ {
+		d := app.DeadLetter{
+			ID:       uuid.New(),
+			UserID:   uuid.New(),
+			Endpoint: fmt.Sprintf("https://push.example.com/%d", i),
+			Message:  []byte("msg"),
+			Attempts: i + 1,
+			Status:   503,
+			Error:    "503 Service Unavailable",
+			Time:     app.Time{Time: now.Add(time.Duration(i) * time.Second)},
+		}
+		must(t, db.CreateDeadLetter(ctx, d))
+		ds = append(ds, d)
+	}
+
+	got, err := db.ReadDeadLetters(ctx, 2)
+	must(t, err)
+	want := []app.DeadLetter{ds[2], ds[1]}
+	if len(got) != len(want) {
+		t.Fatalf("got %d dead letters, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.ID != w.ID || g.UserID != w.UserID || g.Endpoint != w.Endpoint ||
+			string(g.Message) != string(w.Message) ||
+			g.Attempts != w.Attempts || g.Status != w.Status ||
+			g.Error != w.Error || !g.Time.Equal(w.Time.Time) {
+			t.Errorf("dead letter %d: got %+v, want %+v", i, g, w)
+		}
+	}
+}
+
+func testFollows(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	must(t, db.Follow(ctx, bob, alice))
+	must(t, db.Follow(ctx, carol, alice))
+	// following twice is no error and no second follow
+	must(t, db.Follow(ctx, bob, alice))
+	must(t, db.Follow(ctx, alice, bob))
+
+	followers, err := db.ReadFollowers(ctx, alice)
+	must(t, err)
+	assertIDs(t, followers, bob, carol)
+	following, err := db.ReadFollowing(ctx, bob)
+	must(t, err)
+	assertIDs(t, following, alice)
+
+	must(t, db.Unfollow(ctx, bob, alice))
+	// so is unfollowing twice
+	must(t, db.Unfollow(ctx, bob, alice))
+	followers, err = db.ReadFollowers(ctx, alice)
+	must(t, err)
+	assertIDs(t, followers, carol)
+	following, err = db.ReadFollowing(ctx, carol)
+	must(t, err)
+	assertIDs(t, following, alice)
+	following, err = db.ReadFollowing(ctx, bob)
+	must(t, err)
+	assertIDs(t, following)
+}
+
+// assertIDs checks that got holds the IDs of want in any order
+func assertIDs(t *testing.T, got []uuid.UUID, want ...uuid.UUID) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d IDs, want %d", len(got), len(want))
+	}
+	ids := map[uuid.UUID]bool{}
+	for _, id := range got {
+		ids[id] = true
+	}
+	for _, id := range want {
+		if !ids[id] {
+			t.Errorf("got %v, want %v among them", got, id)
+		}
+	}
+}
+
+func testNotificationSettings(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	uid := uuid.New()
+	ns := app.NotificationSettings{
+		UserID:  uid,
+		Classes: map[string]bool{app.ClassNewPost: false, app.ClassMention: true},
+		Muted:   []uuid.UUID{uuid.New(), uuid.New()},
+		QuietHours: &app.QuietHours{
+			Start:    "22:00",
+			End:      "07:30",
+			TimeZone: "Europe/Berlin",
+		},
+	}
+	must(t, db.PutNotificationSettings(ctx, ns))
+	got, err := db.GetNotificationSettings(ctx, uid)
+	must(t, err)
+	assertSettings(t, got, ns)
+
+	// saving again replaces everything
+	ns = app.NotificationSettings{UserID: uid}
+	must(t, db.PutNotificationSettings(ctx, ns))
+	got, err = db.GetNotificationSettings(ctx, uid)
+	must(t, err)
+	assertSettings(t, got, ns)
+}
+
+func assertSettings(t *testing.T, got, want app.NotificationSettings) {
+	t.Helper()
+	if got.UserID != want.UserID {
+		t.Errorf("got user %v, want %v", got.UserID, want.UserID)
+	}
+	if len(got.Classes) != len(want.Classes) {
+		t.Errorf("got classes %v, want %v", got.Classes, want.Classes)
+	}
+	for name, on := range want.Classes {
+		if g, ok := got.Classes[name]; !ok || g != on {
+			t.Errorf("got classes %v, want %v", got.Classes, want.Classes)
+		}
+	}
+	assertIDs(t, got.Muted, want.Muted...)
+	switch {
+	case got.QuietHours == nil && want.QuietHours == nil:
+	case got.QuietHours == nil || want.QuietHours == nil ||
+		*got.QuietHours != *want.QuietHours:
+		t.Errorf("got quiet hours %+v, want %+v", got.QuietHours,
+			want.QuietHours)
+	}
+}
+
+func testNoSuchEntity(t *testing.T, db app.DB) {
+	ctx := context.Background()
+
+	_, err := db.GetUser(ctx, uuid.New())
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("GetUser: got error %v, want ErrNoSuchEntity", err)
+	}
+	_, err = db.GetSubscription(ctx, "https://push.example.com/none")
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("GetSubscription: got error %v, want ErrNoSuchEntity", err)
+	}
+	err = db.DeleteSubscription(ctx, "https://push.example.com/none",
+		app.RemovalUnsubscribed)
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("DeleteSubscription: got error %v, want ErrNoSuchEntity",
+			err)
+	}
+	_, err = db.GetKey(ctx)
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("GetKey: got error %v, want ErrNoSuchEntity", err)
+	}
+	_, err = db.GetSession(ctx, uuid.New())
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("GetSession: got error %v, want ErrNoSuchEntity", err)
+	}
+	err = db.TouchSession(ctx, uuid.New(), time.Now())
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("TouchSession: got error %v, want ErrNoSuchEntity", err)
+	}
+	err = db.RevokeSession(ctx, uuid.New())
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("RevokeSession: got error %v, want ErrNoSuchEntity", err)
+	}
+	_, err = db.GetCredential(ctx, uuid.New())
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("GetCredential: got error %v, want ErrNoSuchEntity", err)
+	}
+	_, err = db.GetNotificationSettings(ctx, uuid.New())
+	if err != app.ErrNoSuchEntity {
+		t.Errorf("GetNotificationSettings: got error %v, want ErrNoSuchEntity",
+			err)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, db app.DB) {
+	ctx := context.Background()
+	const n = 20
+
+	u := newUser("alice")
+	must(t, db.PutUser(ctx, u))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.PutUser(ctx, newUser(fmt.Sprintf("user%d", i)))
+			errs <- db.PutPost(ctx, newPost(u, "post", int64(i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		must(t, err)
+	}
+
+	us, err := db.GetUsers(ctx)
+	must(t, err)
+	if len(us) != n+1 {
+		t.Errorf("got %d users, want %d", len(us), n+1)
+	}
+	ps := readPosts(t, db)
+	if len(ps) != n {
+		t.Errorf("got %d posts, want %d", len(ps), n)
+	}
+}
+
+// readPosts reads the first page of posts, big enough for all tests
+func readPosts(t *testing.T, db app.DB) []app.Post {
+	t.Helper()
+	ps, next, err := db.ReadPosts(context.Background(), "", 1000)
+	must(t, err)
+	if next != "" {
+		t.Errorf("got next cursor %q for a page that holds all posts", next)
+	}
+	return ps
+}
+
+func assertPost(t *testing.T, got, want app.Post) {
+	t.Helper()
+	if got.ID != want.ID || got.User.ID != want.User.ID ||
+		got.Text != want.Text ||
+		!got.Time.Equal(want.Time.Time) || got.Deleted != want.Deleted ||
+		(got.Edited == nil) != (want.Edited == nil) ||
+		got.Edited != nil && !got.Edited.Equal(want.Edited.Time) {
+		t.Errorf("got post %+v, want %+v", got, want)
+	}
+}
+
+func assertSession(t *testing.T, got, want app.Session) {
+	t.Helper()
+	if got.ID != want.ID || got.UserID != want.UserID ||
+		got.RefreshHash != want.RefreshHash || got.Device != want.Device ||
+		got.Revoked != want.Revoked ||
+		!got.Created.Equal(want.Created.Time) ||
+		!got.LastSeen.Equal(want.LastSeen.Time) ||
+		!got.Expires.Equal(want.Expires.Time) {
+		t.Errorf("got session %+v, want %+v", got, want)
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
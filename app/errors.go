@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Problem is the body of every API error response, following RFC 7807
+// (application/problem+json). Code is meant for programs, Detail for humans.
+type Problem struct {
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Detail    string       `json:"detail,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError tells which part of the request was not acceptable
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+const (
+	codeUnauthorized       = "unauthorized"
+	codeInvalidToken       = "invalid_token"
+	codeInvalidCredentials = "invalid_credentials"
+	codeExternalLogin      = "external_login"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeInvalidJSON        = "invalid_json"
+	codeInvalidParameter   = "invalid_parameter"
+	codeConflict           = "conflict"
+	codeNameTaken          = "name_taken"
+	codeTooLarge           = "too_large"
+	codeInternal           = "internal"
+)
+
+// writeError answers the request with a problem document. err is for the
+// server log only and never sent to the client.
+func writeError(w http.ResponseWriter, req *http.Request, status int, code,
+	detail string, err error) {
+
+	writeProblem(w, req, Problem{Status: status, Code: code, Detail: detail},
+		err)
+}
+
+func writeFieldError(w http.ResponseWriter, req *http.Request, field,
+	message string) {
+
+	writeProblem(w, req, Problem{
+		Status: http.StatusBadRequest,
+		Code:   codeInvalidParameter,
+		Detail: "invalid " + field,
+		Fields: []FieldError{{Field: field, Message: message}},
+	}, nil)
+}
+
+func writeProblem(w http.ResponseWriter, req *http.Request, p Problem,
+	err error) {
+
+	p.Title = http.StatusText(p.Status)
+	p.RequestID = requestID(req.Context())
+	if err != nil {
+		log.Printf("request %v: %v (%v)", p.RequestID, p.Detail, err)
+	}
+
+	bs, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("request %v: could not marshal problem (%v)", p.RequestID,
+			err)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(bs)
+}
+
+type requestIDKey struct{}
+
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// withRequestID gives every request an ID to correlate responses with the
+// server log. A sane X-Request-ID from a proxy in front is kept.
+func withRequestID(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(req.Context(), requestIDKey{}, id)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	}
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// putFollow makes the current user follow the user in the path
+func (app *App) putFollow(w http.ResponseWriter, req *http.Request) {
+	app.changeFollow(w, req, app.db.Follow)
+}
+
+// deleteFollow makes the current user stop following the user in the path
+func (app *App) deleteFollow(w http.ResponseWriter, req *http.Request) {
+	app.changeFollow(w, req, app.db.Unfollow)
+}
+
+func (app *App) changeFollow(w http.ResponseWriter, req *http.Request,
+	change func(ctx context.Context, follower, followee uuid.UUID) error) {
+
+	ctx := req.Context()
+
+	id, err := uuid.Parse(PathParam(req, "id"))
+	if err != nil {
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"invalid user id", nil)
+		return
+	}
+	u, err := app.getUser(ctx)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+	if id == u.ID {
+		writeError(w, req, http.StatusBadRequest, codeInvalidParameter,
+			"users can't follow themselves", nil)
+		return
+	}
+
+	_, err = app.db.GetUser(ctx, id)
+	switch err {
+	case nil:
+	case ErrNoSuchEntity:
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			fmt.Sprintf("no user %v", id), nil)
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+
+	err = change(ctx, u.ID, id)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not change following", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getFollowing lists the users the current user follows
+func (app *App) getFollowing(w http.ResponseWriter, req *http.Request) {
+	app.listFollows(w, req, app.db.ReadFollowing)
+}
+
+// getFollowers lists the users following the current user
+func (app *App) getFollowers(w http.ResponseWriter, req *http.Request) {
+	app.listFollows(w, req, app.db.ReadFollowers)
+}
+
+func (app *App) listFollows(w http.ResponseWriter, req *http.Request,
+	read func(context.Context, uuid.UUID) ([]uuid.UUID, error)) {
+
+	ctx := req.Context()
+
+	u, err := app.getUser(ctx)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+	ids, err := read(ctx, u.ID)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not read follows", err)
+		return
+	}
+
+	us := []User{}
+	for _, id := range ids {
+		f, err := app.db.GetUser(ctx, id)
+		// deleted users drop out
+		if err == ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, codeInternal,
+				"could not get user", err)
+			return
+		}
+		us = append(us, f)
+	}
+
+	json, err := json.Marshal(struct {
+		Users []User `json:"users"`
+	}{us})
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal users", err)
+		return
+	}
+	w.Write(json)
+}
@@ -0,0 +1,639 @@
+package app
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryDB is a DB that keeps everything in process memory. It is meant for
+// tests and for local runs without the Datastore emulator.
+type MemoryDB struct {
+	mu       sync.RWMutex
+	users    map[uuid.UUID]User
+	names    map[string]uuid.UUID    // by normalized name
+	subs     map[string]Subscription // by endpoint
+	removals []SubscriptionRemoval
+	posts    map[uuid.UUID]Post
+	sessions map[uuid.UUID]Session
+	creds    map[uuid.UUID]Credential
+	ids      map[identityKey]Identity
+	avatars  map[avatarKey]Avatar
+	tasks    map[uuid.UUID]Task
+	dead     []DeadLetter
+	follows  map[follow]bool
+	settings map[uuid.UUID]NotificationSettings
+	key      *KeyPair
+	// version is the last Version given to a post
+	version int64
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		users:    map[uuid.UUID]User{},
+		subs:     map[string]Subscription{},
+		posts:    map[uuid.UUID]Post{},
+		sessions: map[uuid.UUID]Session{},
+		creds:    map[uuid.UUID]Credential{},
+		names:    map[string]uuid.UUID{},
+		ids:      map[identityKey]Identity{},
+		avatars:  map[avatarKey]Avatar{},
+		tasks:    map[uuid.UUID]Task{},
+		follows:  map[follow]bool{},
+		settings: map[uuid.UUID]NotificationSettings{},
+	}
+}
+
+func (db *MemoryDB) GetUser(ctx context.Context, id uuid.UUID) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	u, ok := db.users[id]
+	if !ok {
+		return User{}, ErrNoSuchEntity
+	}
+	return u, nil
+}
+
+func (db *MemoryDB) GetUsers(ctx context.Context) ([]User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	us := make([]User, 0, len(db.users))
+	for _, u := range db.users {
+		us = append(us, u)
+	}
+	sort.Slice(us, func(i, j int) bool {
+		return us[i].ID.String() < us[j].ID.String()
+	})
+	return us, nil
+}
+
+func (db *MemoryDB) GetUserByName(ctx context.Context, name string) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	uid, ok := db.names[NormalizeName(name)]
+	if !ok {
+		return User{}, ErrNoSuchEntity
+	}
+	return db.users[uid], nil
+}
+
+func (db *MemoryDB) CreateUser(ctx context.Context, u User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[u.ID]; ok {
+		return ErrEntityExists
+	}
+	return db.putUser(u)
+}
+
+func (db *MemoryDB) PutUser(ctx context.Context, u User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.putUser(u)
+}
+
+func (db *MemoryDB) UpdateUser(ctx context.Context, id uuid.UUID,
+	f func(*User) error) (User, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.users[id]
+	if !ok {
+		return User{}, ErrNoSuchEntity
+	}
+	err := f(&u)
+	if err != nil {
+		return User{}, err
+	}
+	u.ID = id
+	err = db.putUser(u)
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+func (db *MemoryDB) putUser(u User) error {
+	key := NormalizeName(u.Name)
+	if uid, ok := db.names[key]; ok && uid != u.ID {
+		return ErrNameTaken
+	}
+
+	if old, ok := db.users[u.ID]; ok {
+		delete(db.names, NormalizeName(old.Name))
+	}
+	db.names[key] = u.ID
+	db.users[u.ID] = u
+	return nil
+}
+
+func (db *MemoryDB) CreateSubscription(ctx context.Context, s Subscription) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.subs[s.Endpoint] = s
+	return nil
+}
+
+func (db *MemoryDB) GetSubscription(ctx context.Context, endpoint string) (Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s, ok := db.subs[endpoint]
+	if !ok {
+		return Subscription{}, ErrNoSuchEntity
+	}
+	return s, nil
+}
+
+func (db *MemoryDB) ReadSubscriptions(ctx context.Context, uid uuid.UUID) ([]Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ss := []Subscription{}
+	for _, s := range db.subs {
+		if s.UserID == uid {
+			ss = append(ss, s)
+		}
+	}
+	return ss, nil
+}
+
+func (db *MemoryDB) ReadAllSubscriptions(ctx context.Context) ([]Subscription, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ss := make([]Subscription, 0, len(db.subs))
+	for _, s := range db.subs {
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+func (db *MemoryDB) DeleteSubscription(ctx context.Context, endpoint, reason string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok := db.subs[endpoint]
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	db.deleteSubscription(s, reason)
+	return nil
+}
+
+// deleteSubscription expects db.mu to be locked
+func (db *MemoryDB) deleteSubscription(s Subscription, reason string) {
+	delete(db.subs, s.Endpoint)
+	db.removals = append(db.removals, SubscriptionRemoval{
+		UserID:   s.UserID,
+		Endpoint: s.Endpoint,
+		Reason:   reason,
+		Time:     Time{time.Now()},
+	})
+}
+
+func (db *MemoryDB) ReadSubscriptionRemovals(ctx context.Context, uid uuid.UUID) ([]SubscriptionRemoval, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	rs := []SubscriptionRemoval{}
+	for i := len(db.removals) - 1; i >= 0; i-- {
+		if db.removals[i].UserID == uid {
+			rs = append(rs, db.removals[i])
+		}
+	}
+	return rs, nil
+}
+
+func (db *MemoryDB) GetKey(ctx context.Context) (KeyPair, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.key == nil {
+		return KeyPair{}, ErrNoSuchEntity
+	}
+	return *db.key, nil
+}
+
+func (db *MemoryDB) PutKey(ctx context.Context, kp KeyPair) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.key = &kp
+	return nil
+}
+
+func (db *MemoryDB) ReadPosts(ctx context.Context, cursor string, limit int) ([]Post, string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var after *postCursor
+	if cursor != "" {
+		c, err := parsePostCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &c
+	}
+
+	ps := make([]Post, 0, len(db.posts))
+	for _, p := range db.posts {
+		if p.Deleted {
+			continue
+		}
+		if after == nil || after.precedes(p) {
+			ps = append(ps, p)
+		}
+	}
+	// newest first
+	sort.Slice(ps, func(i, j int) bool {
+		return cursorOf(ps[i]).precedes(ps[j])
+	})
+
+	if len(ps) <= limit {
+		return ps, "", nil
+	}
+	ps = ps[:limit]
+	return ps, cursorOf(ps[limit-1]).String(), nil
+}
+
+func (db *MemoryDB) GetPost(ctx context.Context, id uuid.UUID) (Post, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	p, ok := db.posts[id]
+	if !ok {
+		return Post{}, ErrNoSuchEntity
+	}
+	return p, nil
+}
+
+func (db *MemoryDB) CreatePost(ctx context.Context, p Post) (Post, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if p2, ok := db.posts[p.ID]; ok {
+		return p2, ErrEntityExists
+	}
+	db.putPost(p)
+	return db.posts[p.ID], nil
+}
+
+func (db *MemoryDB) PutPost(ctx context.Context, p Post) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.putPost(p)
+	return nil
+}
+
+// putPost needs the write lock held
+func (db *MemoryDB) putPost(p Post) {
+	p.User = User{ID: p.User.ID}
+	db.version++
+	p.Version = db.version
+	db.posts[p.ID] = p
+}
+
+func (db *MemoryDB) ReadPostChanges(ctx context.Context, since int64, limit int) ([]Post, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ps := []Post{}
+	for _, p := range db.posts {
+		if p.Version > since {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Version < ps[j].Version
+	})
+
+	if len(ps) > limit {
+		ps = ps[:limit]
+	}
+	return ps, nil
+}
+
+func (db *MemoryDB) CreateSession(ctx context.Context, s Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.sessions[s.ID]; ok {
+		return ErrEntityExists
+	}
+	db.sessions[s.ID] = s
+	return nil
+}
+
+func (db *MemoryDB) GetSession(ctx context.Context, id uuid.UUID) (Session, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	s, ok := db.sessions[id]
+	if !ok {
+		return Session{}, ErrNoSuchEntity
+	}
+	return s, nil
+}
+
+func (db *MemoryDB) TouchSession(ctx context.Context, id uuid.UUID, lastSeen time.Time) error {
+	return db.updateSession(id, func(s *Session) error {
+		if s.Revoked {
+			return ErrStaleSession
+		}
+		s.LastSeen = Time{lastSeen}
+		return nil
+	})
+}
+
+func (db *MemoryDB) RotateRefresh(ctx context.Context, id uuid.UUID, oldHash,
+	newHash string, lastSeen time.Time) error {
+
+	return db.updateSession(id, func(s *Session) error {
+		if s.Revoked || s.RefreshHash != oldHash {
+			return ErrStaleSession
+		}
+		s.RefreshHash = newHash
+		s.LastSeen = Time{lastSeen}
+		return nil
+	})
+}
+
+func (db *MemoryDB) RevokeSession(ctx context.Context, id uuid.UUID) error {
+	return db.updateSession(id, func(s *Session) error {
+		s.Revoked = true
+		return nil
+	})
+}
+
+// updateSession changes a session with f, unless f fails
+func (db *MemoryDB) updateSession(id uuid.UUID, f func(*Session) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok := db.sessions[id]
+	if !ok {
+		return ErrNoSuchEntity
+	}
+	err := f(&s)
+	if err != nil {
+		return err
+	}
+	db.sessions[id] = s
+	return nil
+}
+
+func (db *MemoryDB) ReadSessions(ctx context.Context, uid uuid.UUID) ([]Session, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ss := []Session{}
+	for _, s := range db.sessions {
+		if s.UserID == uid {
+			ss = append(ss, s)
+		}
+	}
+	return ss, nil
+}
+
+func (db *MemoryDB) DeleteSessionSubscriptions(ctx context.Context, sid uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, s := range db.subs {
+		if s.SessionID == sid {
+			db.deleteSubscription(s, RemovalSessionEnded)
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDB) GetCredential(ctx context.Context, uid uuid.UUID) (Credential, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	c, ok := db.creds[uid]
+	if !ok {
+		return Credential{}, ErrNoSuchEntity
+	}
+	return c, nil
+}
+
+func (db *MemoryDB) PutCredential(ctx context.Context, c Credential) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.creds[c.UserID] = c
+	return nil
+}
+
+type identityKey struct {
+	issuer, subject string
+}
+
+func (db *MemoryDB) GetIdentity(ctx context.Context, issuer, subject string) (Identity, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	id, ok := db.ids[identityKey{issuer, subject}]
+	if !ok {
+		return Identity{}, ErrNoSuchEntity
+	}
+	return id, nil
+}
+
+func (db *MemoryDB) CreateIdentity(ctx context.Context, id Identity) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	k := identityKey{id.Issuer, id.Subject}
+	if _, ok := db.ids[k]; ok {
+		return ErrEntityExists
+	}
+	db.ids[k] = id
+	return nil
+}
+
+type avatarKey struct {
+	id   uuid.UUID
+	size int
+}
+
+func (db *MemoryDB) PutAvatar(ctx context.Context, a Avatar) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	a.PNG = append([]byte(nil), a.PNG...)
+	db.avatars[avatarKey{a.ID, a.Size}] = a
+	return nil
+}
+
+func (db *MemoryDB) GetAvatar(ctx context.Context, id uuid.UUID, size int) (Avatar, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	a, ok := db.avatars[avatarKey{id, size}]
+	if !ok {
+		return Avatar{}, ErrNoSuchEntity
+	}
+	return a, nil
+}
+
+func (db *MemoryDB) DeleteAvatar(ctx context.Context, id uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for k := range db.avatars {
+		if k.id == id {
+			delete(db.avatars, k)
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDB) PutTask(ctx context.Context, t Task) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.tasks[t.ID] = t
+	return nil
+}
+
+func (db *MemoryDB) ReadDueTasks(ctx context.Context, now time.Time, limit int) ([]Task, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ts := []Task{}
+	for _, t := range db.tasks {
+		if !t.NotBefore.After(now) {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].NotBefore.Before(ts[j].NotBefore.Time)
+	})
+	if len(ts) > limit {
+		ts = ts[:limit]
+	}
+	return ts, nil
+}
+
+func (db *MemoryDB) DeleteTask(ctx context.Context, id uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.tasks, id)
+	return nil
+}
+
+func (db *MemoryDB) CreateDeadLetter(ctx context.Context, d DeadLetter) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.dead = append(db.dead, d)
+	return nil
+}
+
+func (db *MemoryDB) ReadDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ds := []DeadLetter{}
+	for i := len(db.dead) - 1; i >= 0 && len(ds) < limit; i-- {
+		ds = append(ds, db.dead[i])
+	}
+	return ds, nil
+}
+
+type follow struct {
+	follower uuid.UUID
+	followee uuid.UUID
+}
+
+func (db *MemoryDB) Follow(ctx context.Context, follower, followee uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.follows[follow{follower, followee}] = true
+	return nil
+}
+
+func (db *MemoryDB) Unfollow(ctx context.Context, follower, followee uuid.UUID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.follows, follow{follower, followee})
+	return nil
+}
+
+func (db *MemoryDB) ReadFollowers(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ids := []uuid.UUID{}
+	for f := range db.follows {
+		if f.followee == uid {
+			ids = append(ids, f.follower)
+		}
+	}
+	return ids, nil
+}
+
+func (db *MemoryDB) ReadFollowing(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ids := []uuid.UUID{}
+	for f := range db.follows {
+		if f.follower == uid {
+			ids = append(ids, f.followee)
+		}
+	}
+	return ids, nil
+}
+
+func (db *MemoryDB) GetNotificationSettings(ctx context.Context, uid uuid.UUID) (NotificationSettings, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ns, ok := db.settings[uid]
+	if !ok {
+		return NotificationSettings{}, ErrNoSuchEntity
+	}
+	return copySettings(ns), nil
+}
+
+func (db *MemoryDB) PutNotificationSettings(ctx context.Context, ns NotificationSettings) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.settings[ns.UserID] = copySettings(ns)
+	return nil
+}
+
+// copySettings keeps callers from changing stored settings through the maps
+// and slices they share
+func copySettings(ns NotificationSettings) NotificationSettings {
+	classes := map[string]bool{}
+	for name, on := range ns.Classes {
+		classes[name] = on
+	}
+	ns.Classes = classes
+	ns.Muted = append([]uuid.UUID{}, ns.Muted...)
+	if ns.QuietHours != nil {
+		q := *ns.QuietHours
+		ns.QuietHours = &q
+	}
+	return ns
+}
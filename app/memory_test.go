@@ -0,0 +1,14 @@
+package app_test
+
+import (
+	"testing"
+
+	"github.com/maxhille/elm-pwa-example/app"
+	"github.com/maxhille/elm-pwa-example/app/dbtest"
+)
+
+func TestMemoryDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) app.DB {
+		return app.NewMemoryDB()
+	})
+}
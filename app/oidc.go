@@ -0,0 +1,505 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrExternalLogin = errors.New("Users log in with an identity provider")
+
+// Identity links the account of a user at an identity provider to a User
+type Identity struct {
+	Issuer  string
+	Subject string
+	UserID  uuid.UUID
+}
+
+// ExternalLogin is implemented by user services that leave authentication to
+// an identity provider. StartLogin returns the URL to send the user agent to
+// and a secret, which the client has to keep and hand to FinishLogin with the
+// query of the callback request.
+type ExternalLogin interface {
+	StartLogin(context.Context) (url string, secret string, err error)
+	FinishLogin(ctx context.Context, secret string, query url.Values) (User, error)
+}
+
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, the discovery document is expected
+	// below it at /.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// HTTPClient talks to the provider, a client with a timeout of
+	// oidcTimeout if nil
+	HTTPClient *http.Client
+}
+
+// oidcTimeout keeps a hanging provider from holding up logins for good
+const oidcTimeout = 10 * time.Second
+
+// OIDC is a relying party of an OpenID Connect provider, using the
+// authorization code flow with PKCE
+type OIDC struct {
+	config    OIDCConfig
+	discovery discovery
+	jwks      *jwks
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDC fetches the discovery document of the provider
+func NewOIDC(ctx context.Context, c OIDCConfig) (*OIDC, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: oidcTimeout}
+	}
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+
+	o := &OIDC{config: c}
+	err := o.getJSON(ctx, c.Issuer+"/.well-known/openid-configuration",
+		&o.discovery)
+	if err != nil {
+		return nil, fmt.Errorf("could not get discovery document (%v)", err)
+	}
+	if o.discovery.Issuer != c.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, want %q",
+			o.discovery.Issuer, c.Issuer)
+	}
+	if o.discovery.AuthorizationEndpoint == "" ||
+		o.discovery.TokenEndpoint == "" || o.discovery.JWKSURI == "" {
+
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	o.jwks = &jwks{oidc: o}
+	return o, nil
+}
+
+// IDClaims are the claims of a verified ID token
+type IDClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expires           int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+}
+
+// audience is a single string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(bs []byte) error {
+	var s string
+	if json.Unmarshal(bs, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(bs, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clockSkew is how much the clocks of provider and server may differ
+const clockSkew = time.Minute
+
+// AuthURL returns the URL of the provider's login page. The verifier is the
+// PKCE secret the code is later exchanged with.
+func (o *OIDC) AuthURL(state, nonce, verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(o.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return o.discovery.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// Exchange trades an authorization code for an ID token and verifies it
+func (o *OIDC) Exchange(ctx context.Context, code, verifier,
+	nonce string) (IDClaims, error) {
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if o.config.ClientSecret == "" {
+		form.Set("client_id", o.config.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, o.discovery.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID),
+			url.QueryEscape(o.config.ClientSecret))
+	}
+
+	resp, err := o.config.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return IDClaims{}, fmt.Errorf("could not reach token endpoint (%v)", err)
+	}
+	defer resp.Body.Close()
+
+	tr := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return IDClaims{}, fmt.Errorf("could not decode token response (%v)",
+			err)
+	}
+	if resp.StatusCode == http.StatusBadRequest && tr.Error == "invalid_grant" {
+		return IDClaims{}, ErrInvalidCredentials
+	}
+	if resp.StatusCode != http.StatusOK {
+		return IDClaims{}, fmt.Errorf("token endpoint answered %v %v",
+			resp.StatusCode, tr.Error)
+	}
+
+	return o.Verify(ctx, tr.IDToken, nonce)
+}
+
+// Verify checks the RS256 signature of an ID token against the provider's
+// keys, and that it was issued by the provider for this client and nonce
+func (o *OIDC) Verify(ctx context.Context, token, nonce string) (IDClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return IDClaims{}, ErrInvalidToken
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeSegment(parts[0], &header)
+	if err != nil || header.Alg != "RS256" {
+		return IDClaims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IDClaims{}, ErrInvalidToken
+	}
+	key, err := o.jwks.key(ctx, header.Kid)
+	if err != nil {
+		return IDClaims{}, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig)
+	if err != nil {
+		return IDClaims{}, ErrInvalidToken
+	}
+
+	c := IDClaims{}
+	err = decodeSegment(parts[1], &c)
+	if err != nil {
+		return IDClaims{}, ErrInvalidToken
+	}
+	now := time.Now()
+	switch {
+	case c.Issuer != o.config.Issuer,
+		c.Subject == "",
+		!c.Audience.contains(o.config.ClientID),
+		len(c.Audience) > 1 && c.AuthorizedParty != o.config.ClientID,
+		now.Add(-clockSkew).After(time.Unix(c.Expires, 0)),
+		now.Add(clockSkew).Before(time.Unix(c.IssuedAt, 0)),
+		subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1:
+
+		return IDClaims{}, ErrInvalidToken
+	}
+
+	return c, nil
+}
+
+func (o *OIDC) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.config.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v answered %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(s string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// jwks caches the signing keys of the provider. Keys are fetched again when
+// the cache is old or a token names an unknown key, as happens when the
+// provider rotates its keys, but at most every jwksMinAge.
+type jwks struct {
+	oidc    *OIDC
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+const (
+	jwksMaxAge = time.Hour
+	jwksMinAge = time.Minute
+)
+
+func (j *jwks) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	age := time.Since(j.fetched)
+	k, ok := j.keys[kid]
+	if ok && age < jwksMaxAge {
+		return k, nil
+	}
+	if !ok && age < jwksMinAge {
+		return nil, ErrInvalidToken
+	}
+
+	err := j.fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get provider keys (%v)", err)
+	}
+	k, ok = j.keys[kid]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return k, nil
+}
+
+func (j *jwks) fetch(ctx context.Context) error {
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	err := j.oidc.getJSON(ctx, j.oidc.discovery.JWKSURI, &set)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("could not decode modulus of key %q (%v)", k.Kid,
+				err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return fmt.Errorf("invalid exponent of key %q", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	j.keys = keys
+	j.fetched = time.Now()
+	return nil
+}
+
+// OIDCUserService is a UserService for users of an OpenID Connect provider.
+// The provider's subject identifies a user, who gets an app session after
+// logging in there.
+type OIDCUserService struct {
+	oidc   *OIDC
+	db     DB
+	tokens *Tokens
+}
+
+func NewOIDCUserService(oidc *OIDC, db DB, tokens *Tokens) *OIDCUserService {
+	return &OIDCUserService{oidc: oidc, db: db, tokens: tokens}
+}
+
+type (
+	userKey    struct{}
+	sessionKey struct{}
+)
+
+func (us *OIDCUserService) Current(ctx context.Context) uuid.UUID {
+	return ctx.Value(userKey{}).(uuid.UUID)
+}
+
+func (us *OIDCUserService) CurrentSession(ctx context.Context) uuid.UUID {
+	return ctx.Value(sessionKey{}).(uuid.UUID)
+}
+
+func (us *OIDCUserService) Decorate(req *http.Request) (context.Context, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return req.Context(), errors.New("authorization header missing")
+	}
+	s, err := us.tokens.Verify(req.Context(), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return req.Context(), err
+	}
+	ctx := context.WithValue(req.Context(), userKey{}, s.UserID)
+	return context.WithValue(ctx, sessionKey{}, s.ID), nil
+}
+
+func (us *OIDCUserService) Register(ctx context.Context, name, password string) (User, error) {
+	return User{}, ErrExternalLogin
+}
+
+func (us *OIDCUserService) Login(ctx context.Context, name, password string) (User, error) {
+	return User{}, ErrExternalLogin
+}
+
+func (us *OIDCUserService) GetUserByName(ctx context.Context, name string) (User, error) {
+	return us.db.GetUserByName(ctx, name)
+}
+
+func (us *OIDCUserService) Issue(ctx context.Context, u User, device string) (TokenPair, error) {
+	return us.tokens.Issue(ctx, u, device)
+}
+
+func (us *OIDCUserService) Refresh(ctx context.Context, refresh string) (TokenPair, error) {
+	return us.tokens.Refresh(ctx, refresh)
+}
+
+func (us *OIDCUserService) Revoke(ctx context.Context, sid uuid.UUID) error {
+	return us.tokens.Revoke(ctx, sid)
+}
+
+// StartLogin makes up state, nonce and PKCE verifier of a login, the secret
+// holds all three
+func (us *OIDCUserService) StartLogin(ctx context.Context) (string, string, error) {
+	vs := make([]string, 3)
+	for i := range vs {
+		bs := make([]byte, 32)
+		_, err := rand.Read(bs)
+		if err != nil {
+			return "", "", fmt.Errorf("could not create login secret (%v)", err)
+		}
+		vs[i] = base64.RawURLEncoding.EncodeToString(bs)
+	}
+	state, nonce, verifier := vs[0], vs[1], vs[2]
+
+	return us.oidc.AuthURL(state, nonce, verifier), strings.Join(vs, "."), nil
+}
+
+func (us *OIDCUserService) FinishLogin(ctx context.Context, secret string,
+	query url.Values) (User, error) {
+
+	vs := strings.Split(secret, ".")
+	if len(vs) != 3 || query.Get("error") != "" ||
+		subtle.ConstantTimeCompare([]byte(vs[0]),
+			[]byte(query.Get("state"))) != 1 {
+
+		return User{}, ErrInvalidCredentials
+	}
+	nonce, verifier := vs[1], vs[2]
+
+	c, err := us.oidc.Exchange(ctx, query.Get("code"), verifier, nonce)
+	if err != nil {
+		return User{}, err
+	}
+	return us.userOf(ctx, c)
+}
+
+// userOf returns the user linked to the subject, new subjects get a new user
+func (us *OIDCUserService) userOf(ctx context.Context, c IDClaims) (User, error) {
+	id, err := us.db.GetIdentity(ctx, c.Issuer, c.Subject)
+	if err == ErrNoSuchEntity {
+		id = Identity{Issuer: c.Issuer, Subject: c.Subject, UserID: uuid.New()}
+		err = us.db.CreateIdentity(ctx, id)
+		if err == ErrEntityExists {
+			// a concurrent first login won
+			id, err = us.db.GetIdentity(ctx, c.Issuer, c.Subject)
+		}
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("could not get identity (%v)", err)
+	}
+
+	u, err := us.db.GetUser(ctx, id.UserID)
+	if err != ErrNoSuchEntity {
+		return u, err
+	}
+
+	u = User{ID: id.UserID, Name: nameOf(c), DisplayName: c.Name}
+	err = us.db.CreateUser(ctx, u)
+	if err == ErrNameTaken {
+		// the hash keeps the name the same on retries after failures
+		sum := sha256.Sum256([]byte(c.Issuer + " " + c.Subject))
+		u.Name += "-" + hex.EncodeToString(sum[:3])
+		err = us.db.CreateUser(ctx, u)
+	}
+	if err == ErrEntityExists {
+		return us.db.GetUser(ctx, id.UserID)
+	}
+	return u, err
+}
+
+// nameOf picks the name for a new user from the claims
+func nameOf(c IDClaims) string {
+	for _, n := range []string{c.PreferredUsername, c.Name, c.Email} {
+		if strings.TrimSpace(n) != "" {
+			return strings.TrimSpace(n)
+		}
+	}
+	return "user"
+}
@@ -0,0 +1,356 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubIdP is an OpenID Connect provider that signs ID tokens with generated
+// RSA keys
+type stubIdP struct {
+	*httptest.Server
+	t *testing.T
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PrivateKey
+	fetches   int
+	challenge string
+	claims    map[string]interface{}
+	discovery map[string]string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	idp := &stubIdP{t: t, keys: map[string]*rsa.PrivateKey{}}
+	idp.addKey("k1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, req *http.Request) {
+			idp.mu.Lock()
+			defer idp.mu.Unlock()
+			json.NewEncoder(w).Encode(idp.discovery)
+		})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		idp.fetches++
+		keys := []map[string]string{}
+		for kid, k := range idp.keys {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(
+					big.NewInt(int64(k.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	idp.discovery = map[string]string{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+	}
+	return idp
+}
+
+func (idp *stubIdP) addKey(kid string) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatalf("could not generate key (%v)", err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys[kid] = k
+}
+
+// token answers the code "good" with a token of the claims, if the verifier
+// matches the challenge of the login
+func (idp *stubIdP) token(w http.ResponseWriter, req *http.Request) {
+	idp.mu.Lock()
+	challenge, claims := idp.challenge, idp.claims
+	idp.mu.Unlock()
+
+	user, secret, ok := req.BasicAuth()
+	sum := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+	if !ok || user != "client" || secret != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	if req.PostFormValue("grant_type") != "authorization_code" ||
+		req.PostFormValue("code") != "good" ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"id_token": idp.sign("k1", claims),
+	})
+}
+
+func (idp *stubIdP) sign(kid string, claims map[string]interface{}) string {
+	idp.mu.Lock()
+	k := idp.keys[kid]
+	idp.mu.Unlock()
+	if k == nil {
+		// a key the provider does not publish
+		var err error
+		k, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			idp.t.Fatalf("could not generate key (%v)", err)
+		}
+	}
+
+	segment := func(v interface{}) string {
+		bs, err := json.Marshal(v)
+		if err != nil {
+			idp.t.Fatalf("could not marshal token segment (%v)", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(bs)
+	}
+	signed := segment(map[string]string{"alg": "RS256", "kid": kid}) + "." +
+		segment(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	if err != nil {
+		idp.t.Fatalf("could not sign token (%v)", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (idp *stubIdP) fetchCount() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.fetches
+}
+
+func (idp *stubIdP) claimsFor(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":   idp.URL,
+		"sub":   "subject",
+		"aud":   "client",
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": nonce,
+		"name":  "Some One",
+	}
+}
+
+func (idp *stubIdP) oidc(t *testing.T) *OIDC {
+	o, err := NewOIDC(context.Background(), OIDCConfig{
+		Issuer:       idp.URL + "/",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example/api/oidc/callback",
+	})
+	if err != nil {
+		t.Fatalf("could not create OIDC (%v)", err)
+	}
+	return o
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	idp := newStubIdP(t)
+	o := idp.oidc(t)
+	if o.config.HTTPClient.Timeout == 0 {
+		t.Errorf("default client has no timeout")
+	}
+
+	idp.mu.Lock()
+	idp.discovery["issuer"] = "https://other.example"
+	idp.mu.Unlock()
+	_, err := NewOIDC(context.Background(), OIDCConfig{Issuer: idp.URL})
+	if err == nil {
+		t.Errorf("discovery document of another issuer was accepted")
+	}
+
+	idp.mu.Lock()
+	idp.discovery["issuer"] = idp.URL
+	delete(idp.discovery, "jwks_uri")
+	idp.mu.Unlock()
+	_, err = NewOIDC(context.Background(), OIDCConfig{Issuer: idp.URL})
+	if err == nil {
+		t.Errorf("discovery document without jwks_uri was accepted")
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newStubIdP(t)
+	o := idp.oidc(t)
+
+	u, err := url.Parse(o.AuthURL("state", "nonce", "verifier"))
+	if err != nil {
+		t.Fatalf("could not parse auth URL (%v)", err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("state") != "state" ||
+		q.Get("nonce") != "nonce" || q.Get("client_id") != "client" ||
+		q.Get("code_challenge_method") != "S256" {
+
+		t.Errorf("unexpected auth URL %v", u)
+	}
+	claims := idp.claimsFor("nonce")
+	idp.mu.Lock()
+	idp.challenge, idp.claims = q.Get("code_challenge"), claims
+	idp.mu.Unlock()
+
+	c, err := o.Exchange(context.Background(), "good", "verifier", "nonce")
+	if err != nil {
+		t.Fatalf("could not exchange code (%v)", err)
+	}
+	if c.Subject != "subject" || c.Name != "Some One" {
+		t.Errorf("unexpected claims %+v", c)
+	}
+
+	_, err = o.Exchange(context.Background(), "good", "other", "nonce")
+	if err != ErrInvalidCredentials {
+		t.Errorf("wrong verifier: got %v, want %v", err, ErrInvalidCredentials)
+	}
+	_, err = o.Exchange(context.Background(), "bad", "verifier", "nonce")
+	if err != ErrInvalidCredentials {
+		t.Errorf("wrong code: got %v, want %v", err, ErrInvalidCredentials)
+	}
+	_, err = o.Exchange(context.Background(), "good", "verifier", "other")
+	if err != ErrInvalidToken {
+		t.Errorf("wrong nonce: got %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := newStubIdP(t)
+	o := idp.oidc(t)
+
+	tests := []struct {
+		name   string
+		change func(map[string]interface{})
+		valid  bool
+	}{
+		{"valid", func(map[string]interface{}) {}, true},
+		{"other issuer", func(c map[string]interface{}) {
+			c["iss"] = "https://other.example"
+		}, false},
+		{"no subject", func(c map[string]interface{}) {
+			delete(c, "sub")
+		}, false},
+		{"other audience", func(c map[string]interface{}) {
+			c["aud"] = "other"
+		}, false},
+		{"audiences", func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "client"}
+			c["azp"] = "client"
+		}, true},
+		{"audiences without azp", func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "client"}
+		}, false},
+		{"audiences for other party", func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "client"}
+			c["azp"] = "other"
+		}, false},
+		{"expired", func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		}, false},
+		{"expired within skew", func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-clockSkew / 2).Unix()
+		}, true},
+		{"issued in future", func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(time.Hour).Unix()
+		}, false},
+		{"other nonce", func(c map[string]interface{}) {
+			c["nonce"] = "other"
+		}, false},
+	}
+	for _, test := range tests {
+		c := idp.claimsFor("nonce")
+		test.change(c)
+		_, err := o.Verify(context.Background(), idp.sign("k1", c), "nonce")
+		if test.valid && err != nil {
+			t.Errorf("%v: could not verify (%v)", test.name, err)
+		}
+		if !test.valid && err != ErrInvalidToken {
+			t.Errorf("%v: got %v, want %v", test.name, err, ErrInvalidToken)
+		}
+	}
+
+	token := idp.sign("k1", idp.claimsFor("nonce"))
+	parts := strings.Split(token, ".")
+	tampered := map[string]string{
+		"other claims": parts[0] + "." + strings.Split(
+			idp.sign("k1", idp.claimsFor("other")), ".")[1] + "." + parts[2],
+		"no signature": parts[0] + "." + parts[1] + ".",
+		"alg none": base64.RawURLEncoding.EncodeToString(
+			[]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + ".",
+		"two parts": parts[0] + "." + parts[1],
+	}
+	for name, token := range tampered {
+		_, err := o.Verify(context.Background(), token, "nonce")
+		if err != ErrInvalidToken {
+			t.Errorf("%v: got %v, want %v", name, err, ErrInvalidToken)
+		}
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newStubIdP(t)
+	o := idp.oidc(t)
+	ctx := context.Background()
+
+	verify := func(kid string) error {
+		_, err := o.Verify(ctx, idp.sign(kid, idp.claimsFor("nonce")), "nonce")
+		return err
+	}
+
+	if err := verify("k1"); err != nil {
+		t.Fatalf("could not verify (%v)", err)
+	}
+	if err := verify("k1"); err != nil || idp.fetchCount() != 1 {
+		t.Errorf("keys were not cached: %v, %v fetches", err, idp.fetchCount())
+	}
+
+	// unknown keys are only looked for once in a while
+	if err := verify("k2"); err != ErrInvalidToken {
+		t.Errorf("unknown key: got %v, want %v", err, ErrInvalidToken)
+	}
+	if idp.fetchCount() != 1 {
+		t.Errorf("keys were fetched within %v", jwksMinAge)
+	}
+
+	// a rotated key is found after that
+	idp.addKey("k2")
+	o.jwks.fetched = o.jwks.fetched.Add(-jwksMinAge)
+	if err := verify("k2"); err != nil {
+		t.Errorf("could not verify with rotated key (%v)", err)
+	}
+	if idp.fetchCount() != 2 {
+		t.Errorf("got %v fetches, want 2", idp.fetchCount())
+	}
+
+	// old keys are fetched again
+	o.jwks.fetched = o.jwks.fetched.Add(-jwksMaxAge)
+	if err := verify("k1"); err != nil || idp.fetchCount() != 3 {
+		t.Errorf("old keys were not fetched again: %v, %v fetches", err,
+			idp.fetchCount())
+	}
+}
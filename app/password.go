@@ -0,0 +1,187 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrInvalidCredentials = errors.New("Invalid user name or password")
+
+const minPasswordLength = 8
+
+// Credential is the password of a user, only ever stored hashed
+type Credential struct {
+	UserID       uuid.UUID `datastore:"-"`
+	PasswordHash string
+}
+
+// argon2id parameters as recommended by RFC 9106 for memory constrained
+// environments
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// hashSlots limits how many hashes are computed at once. Each takes
+// argonMemory KiB, and logins come in unauthenticated.
+var hashSlots = make(chan struct{}, 4)
+
+// idKey is argon2.IDKey, waiting for a free slot
+func idKey(pw, salt []byte, time, memory uint32, threads uint8,
+	keyLen uint32) []byte {
+
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+	return argon2.IDKey(pw, salt, time, memory, threads, keyLen)
+}
+
+// HashPassword hashes pw with argon2id and a random salt. The result holds
+// all parameters, so they can be raised later without breaking old hashes.
+func HashPassword(pw string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("could not create salt (%v)", err)
+	}
+
+	key := idKey([]byte(pw), salt, argonTime, argonMemory, argonThreads,
+		argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether pw matches a hash made by HashPassword
+func CheckPassword(hash, pw string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("unknown password hash format")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return false, fmt.Errorf("could not read argon2 parameters (%v)", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("could not decode salt (%v)", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("could not decode key (%v)", err)
+	}
+
+	other := idKey([]byte(pw), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+var dummy struct {
+	once sync.Once
+	hash string
+}
+
+// CheckNoPassword takes as long as CheckPassword, for logins of unknown
+// users. Answering them faster would tell which names exist.
+func CheckNoPassword(pw string) {
+	dummy.once.Do(func() {
+		dummy.hash, _ = HashPassword("")
+	})
+	CheckPassword(dummy.hash, pw)
+}
+
+// Passwords logs users in and registers them with a name and password
+type Passwords struct {
+	db DB
+}
+
+func NewPasswords(db DB) *Passwords {
+	return &Passwords{db: db}
+}
+
+// Login returns the user of name if pw is right. Unknown names take as long
+// as a wrong password.
+func (ps *Passwords) Login(ctx context.Context, name, pw string) (User, error) {
+	u, err := ps.db.GetUserByName(ctx, name)
+	if err == ErrNoSuchEntity {
+		CheckNoPassword(pw)
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	c, err := ps.db.GetCredential(ctx, u.ID)
+	if err == ErrNoSuchEntity {
+		CheckNoPassword(pw)
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	ok, err := CheckPassword(c.PasswordHash, pw)
+	if err != nil {
+		return User{}, err
+	}
+	if !ok {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// Register creates a user of name who logs in with pw
+func (ps *Passwords) Register(ctx context.Context, name, pw string) (User, error) {
+	// spare the hashing and a stray credential for names that are taken
+	_, err := ps.db.GetUserByName(ctx, name)
+	if err == nil {
+		return User{}, ErrNameTaken
+	}
+	if err != ErrNoSuchEntity {
+		return User{}, err
+	}
+
+	hash, err := HashPassword(pw)
+	if err != nil {
+		return User{}, err
+	}
+	u := User{
+		Name: name,
+		ID:   uuid.New(),
+	}
+	// the credential goes first, a user without one could never log in and
+	// would keep the name forever. A credential without a user is never read.
+	err = ps.db.PutCredential(ctx, Credential{UserID: u.ID, PasswordHash: hash})
+	if err != nil {
+		return User{}, err
+	}
+	return u, ps.db.CreateUser(ctx, u)
+}
+
+// ValidatePassword tells what is wrong with a new password, if anything
+func ValidatePassword(pw string) error {
+	if len(pw) < minPasswordLength {
+		return fmt.Errorf("must be at least %d characters long",
+			minPasswordLength)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPasswords(t *testing.T) {
+	ctx := context.Background()
+	ps := NewPasswords(NewMemoryDB())
+
+	u, err := ps.Register(ctx, "Ann", "correct horse")
+	if err != nil {
+		t.Fatalf("could not register (%v)", err)
+	}
+	if _, err = ps.Register(ctx, "ann", "battery staple"); err != ErrNameTaken {
+		t.Errorf("got %v for a taken name, want %v", err, ErrNameTaken)
+	}
+
+	got, err := ps.Login(ctx, "ann", "correct horse")
+	if err != nil || got.ID != u.ID {
+		t.Errorf("got %v (%v) on login, want %v", got.ID, err, u.ID)
+	}
+
+	tests := map[string]struct{ name, pw string }{
+		"wrong password": {"Ann", "battery staple"},
+		"unknown name":   {"Bob", "correct horse"},
+	}
+	for desc, tt := range tests {
+		if _, err = ps.Login(ctx, tt.name, tt.pw); err != ErrInvalidCredentials {
+			t.Errorf("%v: got %v, want %v", desc, err, ErrInvalidCredentials)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// maxPushMessage is the most webpush-go can encrypt into its 4096 byte
+// record, after 86 bytes of header, the 16 byte tag and the padding
+// delimiter
+const maxPushMessage = 3993
+
+// maxPushText is how many characters of a post a push carries
+const maxPushText = 280
+
+// pushMessage is what the service worker gets with a push. For a single
+// changed post it can show a notification and store the post right away.
+type pushMessage struct {
+	// Type is "post" for a changed post and "sync" when the client needs to
+	// ask for changes itself
+	Type string `json:"type"`
+	// Class is the notification class, it tells the client what to show
+	Class string `json:"class,omitempty"`
+	Post  *Post  `json:"post,omitempty"`
+	// Truncated tells that Post.Text is only the start of the text
+	Truncated bool `json:"truncated,omitempty"`
+	// Previous is the sync token right before this change and Token the one
+	// after it. Only a client at Previous can take Token over without
+	// syncing, any other has missed a change.
+	Previous string `json:"previous,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// syncMessage asks the client to sync
+func syncMessage(class string) []byte {
+	bs, _ := json.Marshal(pushMessage{Type: "sync", Class: class})
+	return bs
+}
+
+// notifyTask is the payload of a notify task
+type notifyTask struct {
+	Class string `json:"class"`
+	// PostID is the post that changed, uuid.Nil if several did
+	PostID   uuid.UUID `json:"postId"`
+	Audience Audience  `json:"audience"`
+	// From is the user who changed the post
+	From uuid.UUID `json:"from,omitempty"`
+}
+
+// notify queues a notification of class to audience about a post from
+// changed, uuid.Nil for many
+func (app *App) notify(ctx context.Context, class string, from,
+	postID uuid.UUID, audience Audience) error {
+
+	return app.enqueue(ctx, taskNotify, notifyTask{
+		Class:    class,
+		PostID:   postID,
+		Audience: audience,
+		From:     from,
+	})
+}
+
+// notifyMentions queues a notification to the users the new post p from
+// mentions
+func (app *App) notifyMentions(ctx context.Context, from uuid.UUID,
+	p Post) error {
+
+	uids, err := app.mentioned(ctx, p.Text)
+	if err != nil {
+		return fmt.Errorf("could not find mentions (%v)", err)
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	return app.notify(ctx, ClassMention, from, p.ID,
+		Audience{Kind: AudienceUsers, Users: uids, Except: from})
+}
+
+// runNotifyTask pushes the notification of a notify task to its audience
+func (app *App) runNotifyTask(ctx context.Context, body io.Reader) error {
+	t := notifyTask{}
+	err := json.NewDecoder(body).Decode(&t)
+	// tasks from before payloads had no body
+	if err != nil && err != io.EOF {
+		// running it again won't help
+		log.Printf("dropping broken notify task (%v)", err)
+		return nil
+	}
+	return app.notifyAudience(ctx, t.Audience, app.readNotification(ctx, t))
+}
+
+// readNotification builds the notification of a notify task. Anything that
+// keeps it from describing the post makes it a sync message.
+func (app *App) readNotification(ctx context.Context, t notifyTask) notification {
+	note := notification{class: t.Class, message: syncMessage(t.Class),
+		from: t.From}
+	if t.PostID == uuid.Nil {
+		return note
+	}
+
+	p, err := app.db.GetPost(ctx, t.PostID)
+	if err == nil {
+		ps := []Post{p}
+		err = app.withAuthors(ctx, ps)
+		p = ps[0]
+	}
+	if err != nil {
+		log.Printf("could not read post %v for push (%v)", t.PostID, err)
+		return note
+	}
+	note.message = postMessage(p, t.Class)
+	return note
+}
+
+// postMessage describes p in at most maxPushMessage bytes, shortening its
+// text as needed, or falls back to syncMessage
+func postMessage(p Post, class string) []byte {
+	// the bio is of no use in a notification
+	p.User.Bio = ""
+	m := pushMessage{
+		Type:  "post",
+		Class: class,
+		Post:  &p,
+		// every write counts the version up by one
+		Previous: strconv.FormatInt(p.Version-1, 10),
+		Token:    strconv.FormatInt(p.Version, 10),
+	}
+	if utf8.RuneCountInString(p.Text) > maxPushText {
+		p.Text = string([]rune(p.Text)[:maxPushText])
+		m.Truncated = true
+	}
+
+	bs, err := json.Marshal(m)
+	if err != nil || len(bs) > maxPushMessage {
+		return syncMessage(class)
+	}
+	return bs
+}
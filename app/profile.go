@@ -0,0 +1,322 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Avatar is one size of the avatar image of a user, a PNG of Size x Size
+// pixels
+type Avatar struct {
+	ID   uuid.UUID `datastore:"-"`
+	Size int       `datastore:"-"`
+	PNG  []byte    `datastore:",noindex"`
+}
+
+var avatarSizes = []int{64, 256}
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxAvatarBytes       = 5 << 20
+	// maxAvatarPixels keeps decoding of uploads from eating all memory
+	maxAvatarPixels = 4096 * 4096
+)
+
+// profileEdit is the editable part of a user, fields left out stay as they
+// are
+type profileEdit struct {
+	DisplayName *string `json:"displayName"`
+	Bio         *string `json:"bio"`
+}
+
+func (app *App) getMe(w http.ResponseWriter, req *http.Request) {
+	u, err := app.getUser(req.Context())
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+	writeUser(w, req, u)
+}
+
+func (app *App) patchMe(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	e := profileEdit{}
+	err := json.NewDecoder(req.Body).Decode(&e)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not read json body", err)
+		return
+	}
+	if e.DisplayName != nil {
+		*e.DisplayName = strings.TrimSpace(*e.DisplayName)
+		if utf8.RuneCountInString(*e.DisplayName) > maxDisplayNameLength {
+			writeFieldError(w, req, "displayName", fmt.Sprintf(
+				"must be at most %d characters long", maxDisplayNameLength))
+			return
+		}
+	}
+	if e.Bio != nil && utf8.RuneCountInString(*e.Bio) > maxBioLength {
+		writeFieldError(w, req, "bio", fmt.Sprintf(
+			"must be at most %d characters long", maxBioLength))
+		return
+	}
+
+	u, err := app.db.UpdateUser(ctx, app.user.Current(ctx), func(u *User) error {
+		if e.DisplayName != nil {
+			u.DisplayName = *e.DisplayName
+		}
+		if e.Bio != nil {
+			u.Bio = *e.Bio
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not save user", err)
+		return
+	}
+
+	writeUser(w, req, u)
+}
+
+func (app *App) getUserProfile(w http.ResponseWriter, req *http.Request) {
+	id, err := uuid.Parse(PathParam(req, "id"))
+	if err != nil {
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"invalid user id", nil)
+		return
+	}
+
+	u, err := app.db.GetUser(req.Context(), id)
+	switch err {
+	case nil:
+	case ErrNoSuchEntity:
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			fmt.Sprintf("no user %v", id), nil)
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+	writeUser(w, req, u)
+}
+
+// putAvatar replaces the avatar of the user with the PNG, JPEG or GIF image
+// in the request body. The image is cropped to a square and scaled to all
+// avatarSizes.
+func (app *App) putAvatar(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	bs, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body,
+		maxAvatarBytes))
+	if err != nil {
+		writeError(w, req, http.StatusRequestEntityTooLarge, codeTooLarge,
+			fmt.Sprintf("avatar images can be at most %d bytes",
+				maxAvatarBytes), nil)
+		return
+	}
+	img, err := decodeAvatar(bs)
+	if err != nil {
+		writeFieldError(w, req, "body", err.Error())
+		return
+	}
+
+	// a new ID for every upload lets clients cache avatars forever
+	id := uuid.New()
+	for _, size := range avatarSizes {
+		buf := bytes.Buffer{}
+		err = png.Encode(&buf, scaleSquare(img, size))
+		if err == nil {
+			err = app.db.PutAvatar(ctx, Avatar{ID: id, Size: size,
+				PNG: buf.Bytes()})
+		}
+		if err != nil {
+			writeError(w, req, http.StatusInternalServerError, codeInternal,
+				"could not save avatar", err)
+			return
+		}
+	}
+
+	old := ""
+	u, err := app.db.UpdateUser(ctx, app.user.Current(ctx), func(u *User) error {
+		old = u.Avatar
+		u.Avatar = id.String()
+		return nil
+	})
+	if err != nil {
+		// nobody points to the new images
+		app.deleteAvatar(ctx, id.String())
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not save user", err)
+		return
+	}
+	app.deleteAvatar(ctx, old)
+
+	writeUser(w, req, u)
+}
+
+func (app *App) deleteMyAvatar(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	old := ""
+	_, err := app.db.UpdateUser(ctx, app.user.Current(ctx), func(u *User) error {
+		old = u.Avatar
+		u.Avatar = ""
+		return nil
+	})
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not save user", err)
+		return
+	}
+	app.deleteAvatar(ctx, old)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAvatar drops the images of a replaced avatar. Failing is not worth
+// failing the request for, the user already points to the new one.
+func (app *App) deleteAvatar(ctx context.Context, avatar string) {
+	id, err := uuid.Parse(avatar)
+	if err != nil {
+		return
+	}
+	err = app.db.DeleteAvatar(ctx, id)
+	if err != nil {
+		log.Printf("request %v: could not delete avatar %v (%v)",
+			requestID(ctx), id, err)
+	}
+}
+
+// getAvatar serves avatar images. They need no authorization, as <img>
+// elements can't send tokens, and never change.
+func (app *App) getAvatar(w http.ResponseWriter, req *http.Request) {
+	id, err := uuid.Parse(PathParam(req, "id"))
+	size, err2 := strconv.Atoi(PathParam(req, "size"))
+	if err != nil || err2 != nil {
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"no such avatar", nil)
+		return
+	}
+
+	a, err := app.db.GetAvatar(req.Context(), id, size)
+	switch err {
+	case nil:
+	case ErrNoSuchEntity:
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"no such avatar", nil)
+		return
+	default:
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get avatar", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(a.PNG)
+}
+
+func writeUser(w http.ResponseWriter, req *http.Request, u User) {
+	json, err := json.Marshal(u)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal user", err)
+		return
+	}
+	w.Write(json)
+}
+
+func decodeAvatar(bs []byte) (image.Image, error) {
+	c, format, err := image.DecodeConfig(bytes.NewReader(bs))
+	if err != nil {
+		return nil, errors.New("not a png, jpeg or gif image")
+	}
+	if c.Width < 1 || c.Height < 1 {
+		return nil, errors.New("image is empty")
+	}
+	if c.Width*c.Height > maxAvatarPixels {
+		return nil, fmt.Errorf("%v image of %dx%d pixels is too large",
+			format, c.Width, c.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(bs))
+	if err != nil {
+		return nil, fmt.Errorf("broken %v image (%v)", format, err)
+	}
+	return img, nil
+}
+
+// scaleSquare crops the center square of img and scales it to size x size
+// pixels. Every target pixel averages the source pixels it covers.
+func scaleSquare(img image.Image, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := span(y, size, side)
+		for x := 0; x < size; x++ {
+			sx0, sx1 := span(x, size, side)
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					c := color.NRGBA64Model.Convert(
+						img.At(x0+sx, y0+sy)).(color.NRGBA64)
+					// weigh by alpha, so transparent pixels don't darken
+					r += uint64(c.R) * uint64(c.A)
+					g += uint64(c.G) * uint64(c.A)
+					b += uint64(c.B) * uint64(c.A)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			if a == 0 {
+				continue
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / a >> 8),
+				G: uint8(g / a >> 8),
+				B: uint8(b / a >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// span returns the source pixels [from, to) that target pixel i of n covers,
+// when side source pixels are scaled to n. It is never empty.
+func span(i, n, side int) (int, int) {
+	from := i * side / n
+	to := (i + 1) * side / n
+	if to <= from {
+		to = from + 1
+	}
+	return from, to
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestScaleSquare(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	// blue in the center square, red around it
+	striped := func(w, h int) image.Image {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := red
+				if w > h && x >= (w-h)/2 && x < (w+h)/2 ||
+					h >= w && y >= (h-w)/2 && y < (h+w)/2 {
+					c = blue
+				}
+				img.SetNRGBA(x, y, c)
+			}
+		}
+		return img
+	}
+
+	// bounds need not start at 0,0
+	offset := striped(8, 4).(*image.NRGBA).SubImage(image.Rect(2, 0, 6, 4))
+	tests := map[string]struct {
+		img  image.Image
+		size int
+	}{
+		"wide":     {striped(6, 2), 2},
+		"tall":     {striped(2, 6), 2},
+		"down":     {striped(300, 100), 64},
+		"up":       {striped(3, 1), 64},
+		"offset":   {offset, 4},
+		"one size": {striped(1, 1), 1},
+	}
+	for name, tt := range tests {
+		dst := scaleSquare(tt.img, tt.size)
+		if b := dst.Bounds(); b.Dx() != tt.size || b.Dy() != tt.size {
+			t.Errorf("%v: got %v, want %dx%d", name, b, tt.size, tt.size)
+			continue
+		}
+		for y := 0; y < tt.size; y++ {
+			for x := 0; x < tt.size; x++ {
+				if c := dst.NRGBAAt(x, y); c != blue {
+					t.Fatalf("%v: got %v at %d,%d, want %v", name, c, x, y,
+						blue)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeAvatar(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		t.Helper()
+		buf := bytes.Buffer{}
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	img, err := decodeAvatar(encode(image.NewGray(image.Rect(0, 0, 30, 20))))
+	if err != nil {
+		t.Fatalf("could not decode png (%v)", err)
+	}
+	if b := img.Bounds(); b.Dx() != 30 || b.Dy() != 20 {
+		t.Errorf("got bounds %v, want 30x20", b)
+	}
+
+	tests := map[string][]byte{
+		"not an image": []byte("GIF89a, or so it says"),
+		"empty":        {},
+		"too large":    encode(image.NewGray(image.Rect(0, 0, 4097, 4097))),
+		"broken":       encode(image.NewGray(image.Rect(0, 0, 30, 20)))[:60],
+	}
+	for name, bs := range tests {
+		if _, err := decodeAvatar(bs); err == nil {
+			t.Errorf("%v: got no error", name)
+		}
+	}
+}
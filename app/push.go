@@ -0,0 +1,411 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/SherClockHolmes/webpush-go"
+	"github.com/google/uuid"
+)
+
+// SubscriptionRemoval records that a subscription was deleted, and why
+type SubscriptionRemoval struct {
+	UserID   uuid.UUID `json:"-"`
+	Endpoint string    `json:"endpoint"`
+	Reason   string    `json:"reason"`
+	Time     Time      `json:"time"`
+}
+
+// reasons for removing a subscription
+const (
+	RemovalUnsubscribed = "unsubscribed"
+	RemovalSessionEnded = "session_ended"
+	// the push service does not know the subscription (404)
+	RemovalNotFound = "not_found"
+	// the subscription expired or was revoked by the user agent (410)
+	RemovalExpired = "expired"
+)
+
+// maxListedRemovals is how many removals GET /api/subscription lists
+const maxListedRemovals = 20
+
+// PushConfig tunes the sending of push notifications. Zero fields get
+// the defaults of DefaultPushConfig.
+type PushConfig struct {
+	// Workers is how many notifications are sent at the same time
+	Workers int
+	// Timeout limits every single request to a push service
+	Timeout time.Duration
+	// Subscriber is the contact push services can reach the sender at
+	Subscriber string
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+	// MaxAttempts is how often a notification is tried before it ends up
+	// as a DeadLetter
+	MaxAttempts int
+	// RetryBase is the delay before the first retry, it doubles for every
+	// further one up to RetryMax
+	RetryBase time.Duration
+	RetryMax  time.Duration
+	// Classes holds the options of the notification classes by name,
+	// missing ones come from DefaultPushConfig
+	Classes map[string]NotificationClass
+}
+
+// NotificationClass holds the options push services get for one kind of
+// notification
+type NotificationClass struct {
+	// TTL is how long a push service keeps a notification for a device
+	// that is offline
+	TTL time.Duration
+	// Urgency lets devices save battery on the less important ones
+	Urgency webpush.Urgency
+	// Topic makes a notification replace an undelivered earlier one with
+	// the same Topic, empty for none. At most 32 characters of the URL safe
+	// base64 alphabet.
+	Topic string
+}
+
+// notification classes
+const (
+	ClassNewPost = "new-post"
+	// ClassMention goes to the users a new post mentions
+	ClassMention = "mention"
+	// ClassPostChanged tells about edits and deletions, clients only update
+	// what they show already
+	ClassPostChanged = "post-changed"
+)
+
+var DefaultPushConfig = PushConfig{
+	Workers:     16,
+	Timeout:     10 * time.Second,
+	Subscriber:  "<mh@lambdasoup.com>",
+	MaxAttempts: 5,
+	RetryBase:   30 * time.Second,
+	RetryMax:    time.Hour,
+	Classes: map[string]NotificationClass{
+		// the latest post tells clients whether they missed some and need
+		// to sync, so earlier ones can collapse
+		ClassNewPost: {
+			TTL:     24 * time.Hour,
+			Urgency: webpush.UrgencyNormal,
+			Topic:   "posts",
+		},
+		ClassMention: {
+			TTL:     7 * 24 * time.Hour,
+			Urgency: webpush.UrgencyHigh,
+		},
+		// kept apart from new posts, so they don't replace those
+		ClassPostChanged: {
+			TTL:     24 * time.Hour,
+			Urgency: webpush.UrgencyLow,
+			Topic:   "changes",
+		},
+	},
+}
+
+func (c PushConfig) withDefaults() PushConfig {
+	if c.Workers <= 0 {
+		c.Workers = DefaultPushConfig.Workers
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultPushConfig.Timeout
+	}
+	if c.Subscriber == "" {
+		c.Subscriber = DefaultPushConfig.Subscriber
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = DefaultPushConfig.MaxAttempts
+	}
+	if c.RetryBase <= 0 {
+		c.RetryBase = DefaultPushConfig.RetryBase
+	}
+	if c.RetryMax <= 0 {
+		c.RetryMax = DefaultPushConfig.RetryMax
+	}
+	classes := map[string]NotificationClass{}
+	for name, class := range DefaultPushConfig.Classes {
+		classes[name] = class
+	}
+	for name, class := range c.Classes {
+		classes[name] = class
+	}
+	c.Classes = classes
+	return c
+}
+
+// class returns the options of a notification class, unknown ones are sent
+// like new posts
+func (c PushConfig) class(name string) NotificationClass {
+	class, ok := c.Classes[name]
+	if !ok {
+		return c.Classes[ClassNewPost]
+	}
+	return class
+}
+
+// notification is a push message, the name of its class and the user it
+// is from
+type notification struct {
+	class   string
+	message []byte
+	from    uuid.UUID
+}
+
+// PushResult sums up the outcome of sending to many subscriptions
+type PushResult struct {
+	// Sent were accepted by the push service
+	Sent int
+	// Retrying failed for now and will be tried again later
+	Retrying int
+	// Failed were given up on
+	Failed int
+	// Removed were gone and have been deleted
+	Removed int
+	// Dropped were not wanted by their user
+	Dropped int
+	// Deferred wait for the quiet hours of their user to end
+	Deferred int
+	// Skipped were not tried, because the context was cancelled
+	Skipped int
+}
+
+func (r PushResult) String() string {
+	return fmt.Sprintf("%d sent, %d retrying, %d failed, %d removed, "+
+		"%d dropped, %d deferred, %d skipped", r.Sent, r.Retrying, r.Failed,
+		r.Removed, r.Dropped, r.Deferred, r.Skipped)
+}
+
+type pushOutcome int
+
+const (
+	pushSent pushOutcome = iota
+	pushRetrying
+	pushFailed
+	pushRemoved
+	pushDropped
+	pushDeferred
+)
+
+func (r *PushResult) add(o pushOutcome) {
+	switch o {
+	case pushSent:
+		r.Sent++
+	case pushRetrying:
+		r.Retrying++
+	case pushFailed:
+		r.Failed++
+	case pushRemoved:
+		r.Removed++
+	case pushDropped:
+		r.Dropped++
+	case pushDeferred:
+		r.Deferred++
+	}
+}
+
+// notifyAudience pushes note to the subscriptions of everyone in a
+func (app *App) notifyAudience(ctx context.Context, a Audience,
+	note notification) error {
+
+	// get server keys
+	k, err := app.db.GetKey(ctx)
+	if err == ErrNoSuchEntity {
+		// subscribing needs the key, so there is no one to notify
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get server key: %v", err)
+	}
+	// get user keys
+	ss, err := app.resolveAudience(ctx, a)
+	if err == errUnknownAudience {
+		// trying again won't help
+		log.Printf("dropping notification for unknown audience %q", a.Kind)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	r := app.fanOut(ctx, ss, note, k)
+	log.Printf("notified %d subscriptions in %v: %v", len(ss),
+		time.Since(start), r)
+
+	return nil
+}
+
+// fanOut sends note to all subscriptions, app.push.Workers at a time. It
+// returns when all are done, or the running ones are after ctx is cancelled.
+func (app *App) fanOut(ctx context.Context, ss []Subscription, note notification,
+	k KeyPair) PushResult {
+
+	workers := app.push.Workers
+	if len(ss) < workers {
+		workers = len(ss)
+	}
+
+	jobs := make(chan Subscription)
+	outcomes := make(chan pushOutcome)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				outcomes <- app.deliver(ctx, s, note, k, 1)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, s := range ss {
+			select {
+			case jobs <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(outcomes)
+	}()
+
+	r := PushResult{}
+	n := 0
+	for o := range outcomes {
+		r.add(o)
+		n++
+	}
+	r.Skipped = len(ss) - n
+	return r
+}
+
+// deliver makes attempt n to push note to s, unless the notification
+// settings of its user drop or defer it. Gone subscriptions are deleted,
+// temporary failures tried again later and permanent ones recorded as a
+// DeadLetter.
+func (app *App) deliver(ctx context.Context, s Subscription, note notification,
+	k KeyPair, n int) pushOutcome {
+
+	drop, until := app.screen(ctx, s, note, time.Now())
+	if drop {
+		return pushDropped
+	}
+	if !until.IsZero() {
+		err := app.enqueuePush(ctx, s, note, n, until)
+		if err == nil {
+			return pushDeferred
+		}
+		// better an unwanted notification than a lost one
+		log.Printf("could not defer notification to %v, sending it now (%v)",
+			s.Endpoint, err)
+	}
+
+	a := app.send(ctx, s, note, k)
+	switch {
+	case a.err == nil && a.status < 300:
+		return pushSent
+	case a.status == http.StatusNotFound:
+		return app.prune(ctx, s, RemovalNotFound)
+	case a.status == http.StatusGone:
+		return app.prune(ctx, s, RemovalExpired)
+	case a.temporary() && n < app.push.MaxAttempts:
+		return app.retry(ctx, s, note, n, a)
+	}
+	app.deadLetter(ctx, s, note, n, a)
+	return pushFailed
+}
+
+// attempt is how a push service answered to one notification
+type attempt struct {
+	// status is 0 if there was no response
+	status     int
+	retryAfter time.Duration
+	err        error
+}
+
+// temporary tells whether trying again later might succeed
+func (a attempt) temporary() bool {
+	if a.err != nil {
+		// only errors of the HTTP request, not of encrypting the message
+		_, ok := a.err.(*url.Error)
+		return ok
+	}
+	return a.status == http.StatusTooManyRequests || a.status >= 500
+}
+
+func (a attempt) String() string {
+	if a.err != nil {
+		return a.err.Error()
+	}
+	return fmt.Sprintf("%d %v", a.status, http.StatusText(a.status))
+}
+
+// send pushes note to one subscription, giving up after app.push.Timeout
+func (app *App) send(ctx context.Context, s Subscription, note notification,
+	k KeyPair) attempt {
+
+	reqCtx, cancel := context.WithTimeout(ctx, app.push.Timeout)
+	defer cancel()
+
+	ws := webpush.Subscription{
+		Endpoint: s.Endpoint,
+		Keys:     webpush.Keys{Auth: s.Auth, P256dh: s.P256dh},
+	}
+	class := app.push.class(note.class)
+	// webpush appends to the message, which is shared by all workers. With
+	// no room left it has to copy.
+	message := note.message[:len(note.message):len(note.message)]
+	res, err := webpush.SendNotification(message, &ws, &webpush.Options{
+		HTTPClient:      contextClient{reqCtx, app.push.Client},
+		Subscriber:      app.push.Subscriber,
+		VAPIDPrivateKey: k.SK,
+		VAPIDPublicKey:  k.PK,
+		TTL:             int(class.TTL / time.Second),
+		Urgency:         class.Urgency,
+		Topic:           class.Topic,
+	})
+	if err != nil {
+		return attempt{err: err}
+	}
+	res.Body.Close()
+	retryAfter := parseRetryAfter(res.Header.Get("Retry-After"), time.Now(),
+		app.push.RetryMax)
+	return attempt{status: res.StatusCode, retryAfter: retryAfter}
+}
+
+// contextClient adds a context to the requests of webpush, which has no
+// other way to take one
+type contextClient struct {
+	ctx    context.Context
+	client *http.Client
+}
+
+func (c contextClient) Do(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req.WithContext(c.ctx))
+}
+
+// prune deletes a subscription the push service reports as gone, so it is
+// not pushed to again
+func (app *App) prune(ctx context.Context, s Subscription, reason string) pushOutcome {
+	err := app.db.DeleteSubscription(ctx, s.Endpoint, reason)
+	// someone else might have pruned it already
+	if err != nil && err != ErrNoSuchEntity {
+		log.Printf("could not delete subscription %v (%v)", s.Endpoint, err)
+		return pushFailed
+	}
+	log.Printf("deleted subscription %v of user %v: %v", s.Endpoint, s.UserID,
+		reason)
+	return pushRemoved
+}
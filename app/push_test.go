@@ -0,0 +1,68 @@
+package app
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/SherClockHolmes/webpush-go"
+)
+
+func TestFanOut(t *testing.T) {
+	mu := sync.Mutex{}
+	received := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		ioutil.ReadAll(req.Body)
+		mu.Lock()
+		received++
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	sk, pk, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	ss := make([]Subscription, n)
+	for i := range ss {
+		_, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth := make([]byte, 16)
+		rand.Read(auth)
+		ss[i] = Subscription{
+			Endpoint: srv.URL + "/" + strconv.Itoa(i),
+			P256dh: base64.RawURLEncoding.EncodeToString(
+				elliptic.Marshal(elliptic.P256(), x, y)),
+			Auth: base64.RawURLEncoding.EncodeToString(auth),
+		}
+	}
+
+	app := &App{
+		db:   NewMemoryDB(),
+		push: PushConfig{Workers: 8, Client: srv.Client()}.withDefaults(),
+	}
+	// room to spare, like json.Marshal might leave
+	message := make([]byte, 0, 4096)
+	message = append(message, syncMessage(ClassNewPost)...)
+	note := notification{class: ClassNewPost, message: message}
+
+	r := app.fanOut(context.Background(), ss, note, KeyPair{PK: pk, SK: sk})
+	mu.Lock()
+	defer mu.Unlock()
+	if r.Sent != n || received != n {
+		t.Errorf("got %v with %d received, want %d sent", r, received, n)
+	}
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeadLetter records a notification that was given up on
+type DeadLetter struct {
+	ID       uuid.UUID
+	UserID   uuid.UUID
+	Endpoint string
+	Message  []byte
+	Attempts int
+	// Status is the last answer of the push service, 0 if there was none
+	Status int
+	Error  string
+	Time   Time
+}
+
+const taskPush = "push"
+
+// pushTask is a notification to one subscription that failed before
+type pushTask struct {
+	Endpoint string `json:"endpoint"`
+	Class    string `json:"class"`
+	Message  []byte `json:"message"`
+	// From is the user the notification is from
+	From uuid.UUID `json:"from,omitempty"`
+	// Attempt counts from 1, the first try was part of a fan-out
+	Attempt int `json:"attempt"`
+}
+
+// retry queues attempt n+1 after failed attempt n
+func (app *App) retry(ctx context.Context, s Subscription, note notification,
+	n int, a attempt) pushOutcome {
+
+	at := time.Now().Add(app.push.retryDelay(n, a.retryAfter))
+	err := app.enqueuePush(ctx, s, note, n+1, at)
+	if err != nil {
+		log.Printf("could not queue retry for %v (%v)", s.Endpoint, err)
+		app.deadLetter(ctx, s, note, n, a)
+		return pushFailed
+	}
+	return pushRetrying
+}
+
+// enqueuePush queues attempt n to push note to s at time at
+func (app *App) enqueuePush(ctx context.Context, s Subscription,
+	note notification, n int, at time.Time) error {
+
+	payload, err := json.Marshal(pushTask{
+		Endpoint: s.Endpoint,
+		Class:    note.class,
+		Message:  note.message,
+		From:     note.from,
+		Attempt:  n,
+	})
+	if err != nil {
+		return err
+	}
+	return app.tasks.Enqueue(ctx, Task{
+		ID:        uuid.New(),
+		Kind:      taskPush,
+		Payload:   payload,
+		NotBefore: Time{at},
+	})
+}
+
+// runPushTask makes the next attempt of a failed notification
+func (app *App) runPushTask(ctx context.Context, body io.Reader) error {
+	t := pushTask{}
+	err := json.NewDecoder(body).Decode(&t)
+	if err != nil {
+		// running it again won't help
+		log.Printf("dropping broken push task (%v)", err)
+		return nil
+	}
+
+	s, err := app.db.GetSubscription(ctx, t.Endpoint)
+	if err == ErrNoSuchEntity {
+		// unsubscribed in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	k, err := app.db.GetKey(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get server key: %v", err)
+	}
+
+	note := notification{class: t.Class, message: t.Message, from: t.From}
+	o := app.deliver(ctx, s, note, k, t.Attempt)
+	if o == pushSent {
+		log.Printf("delivered notification to %v on attempt %d", s.Endpoint,
+			t.Attempt)
+	}
+	return nil
+}
+
+func (app *App) deadLetter(ctx context.Context, s Subscription,
+	note notification, n int, a attempt) {
+
+	log.Printf("giving up on notification to %v after %d attempts: %v",
+		s.Endpoint, n, a)
+	err := app.db.CreateDeadLetter(ctx, DeadLetter{
+		ID:       uuid.New(),
+		UserID:   s.UserID,
+		Endpoint: s.Endpoint,
+		Message:  note.message,
+		Attempts: n,
+		Status:   a.status,
+		Error:    a.String(),
+		Time:     Time{time.Now()},
+	})
+	if err != nil {
+		log.Printf("could not record dead letter for %v (%v)", s.Endpoint, err)
+	}
+}
+
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// retryDelay is how long to wait after failed attempt n. A Retry-After of
+// the push service wins, otherwise the delay doubles with every attempt.
+// Half of it is random, so the retries of one fan-out spread out.
+func (c PushConfig) retryDelay(n int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := c.RetryBase
+	for i := 1; i < n && d < c.RetryMax; i++ {
+		d *= 2
+	}
+	if d > c.RetryMax {
+		d = c.RetryMax
+	}
+
+	jitter.Lock()
+	defer jitter.Unlock()
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After header, which holds either seconds
+// or a date. It is 0 if there is none, and at most max.
+func parseRetryAfter(h string, now time.Time, max time.Duration) time.Duration {
+	if h == "" {
+		return 0
+	}
+	d := time.Duration(0)
+	secs, err := strconv.ParseInt(h, 10, 64)
+	// out of range numbers come back as the largest or smallest int64
+	if err == nil || errors.Is(err, strconv.ErrRange) {
+		// compared before multiplying, which could overflow
+		switch {
+		case secs < 0:
+			return 0
+		case secs > int64(max/time.Second):
+			return max
+		}
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(h); err == nil {
+		d = t.Sub(now)
+	}
+	switch {
+	case d < 0:
+		return 0
+	case d > max:
+		return max
+	}
+	return d
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	date := func(d time.Duration) string {
+		return now.Add(d).UTC().Format(http.TimeFormat)
+	}
+	tests := map[string]time.Duration{
+		"":                     0,
+		"garbage":              0,
+		"120":                  2 * time.Minute,
+		"-5":                   0,
+		"7200":                 time.Hour,
+		"9223372036854775807":  time.Hour,
+		"99999999999999999999": time.Hour,
+		date(time.Minute):      time.Minute,
+		date(2 * time.Hour):    time.Hour,
+		date(-time.Minute):     0,
+	}
+	for h, want := range tests {
+		if got := parseRetryAfter(h, now, time.Hour); got != want {
+			t.Errorf("%q: got %v, want %v", h, got, want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Router dispatches requests by method and path. Path patterns are split
+// into segments, a segment like {id} matches any non-empty segment and is
+// available to the handler through PathParam. If several patterns match,
+// static segments win over parameters.
+//
+// Requests for a known path with an unknown method get a 405 with an Allow
+// header, OPTIONS is answered for every path and HEAD is served by the GET
+// handler.
+type Router struct {
+	routes []*route
+}
+
+type route struct {
+	segments []string
+	handlers map[string]http.HandlerFunc
+}
+
+type paramsKey struct{}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+func (r *Router) Handle(method, pattern string, h http.HandlerFunc) {
+	segments := split(pattern)
+	for _, rt := range r.routes {
+		if equal(rt.segments, segments) {
+			rt.handlers[method] = h
+			return
+		}
+	}
+
+	r.routes = append(r.routes, &route{
+		segments: segments,
+		handlers: map[string]http.HandlerFunc{method: h},
+	})
+}
+
+// PathParam returns the value of the {name} segment of the matched pattern
+func PathParam(req *http.Request, name string) string {
+	params, _ := req.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rt, params := r.match(split(req.URL.Path))
+	if rt == nil {
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			"no such resource", nil)
+		return
+	}
+
+	h, ok := rt.handlers[req.Method]
+	if !ok && req.Method == http.MethodHead {
+		// net/http drops the body of HEAD responses
+		h, ok = rt.handlers[http.MethodGet]
+	}
+	if !ok {
+		w.Header().Set("Allow", rt.allow())
+		if req.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, req, http.StatusMethodNotAllowed, codeMethodNotAllowed,
+			req.Method+" is not allowed here", nil)
+		return
+	}
+
+	if len(params) > 0 {
+		ctx := context.WithValue(req.Context(), paramsKey{}, params)
+		req = req.WithContext(ctx)
+	}
+	h(w, req)
+}
+
+func (r *Router) match(segments []string) (*route, map[string]string) {
+	var best *route
+	for _, rt := range r.routes {
+		if !rt.matches(segments) {
+			continue
+		}
+		if best == nil || rt.moreSpecific(best) {
+			best = rt
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	params := map[string]string{}
+	for i, s := range best.segments {
+		if name, ok := param(s); ok {
+			params[name] = segments[i]
+		}
+	}
+	return best, params
+}
+
+func (rt *route) matches(segments []string) bool {
+	if len(rt.segments) != len(segments) {
+		return false
+	}
+	for i, s := range rt.segments {
+		if _, ok := param(s); ok {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific compares two routes matching the same path, the first
+// static segment where the other has a parameter decides
+func (rt *route) moreSpecific(other *route) bool {
+	for i, s := range rt.segments {
+		_, p1 := param(s)
+		_, p2 := param(other.segments[i])
+		if p1 != p2 {
+			return p2
+		}
+	}
+	return false
+}
+
+func (rt *route) allow() string {
+	ms := []string{http.MethodOptions}
+	for m := range rt.handlers {
+		ms = append(ms, m)
+	}
+	if _, ok := rt.handlers[http.MethodGet]; ok {
+		if _, ok := rt.handlers[http.MethodHead]; !ok {
+			ms = append(ms, http.MethodHead)
+		}
+	}
+	sort.Strings(ms)
+	return strings.Join(ms, ", ")
+}
+
+func param(segment string) (string, bool) {
+	if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+func split(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	route := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name + " " + PathParam(req, "id") + " " +
+				PathParam(req, "size")))
+		}
+	}
+	// parameters come first, static segments must win anyway
+	r.Handle("GET", "/api/users/{id}", route("user"))
+	r.Handle("GET", "/api/users/me", route("me"))
+	r.Handle("PATCH", "/api/users/me", route("patch me"))
+	r.Handle("GET", "/api/avatars/{id}/{size}", route("avatar"))
+	r.Handle("DELETE", "/api/posts/{id}", route("delete post"))
+
+	tests := []struct {
+		method, path string
+		status       int
+		body, allow  string
+	}{
+		{"GET", "/api/users/42", 200, "user 42 ", ""},
+		{"GET", "/api/users/me", 200, "me  ", ""},
+		{"PATCH", "/api/users/me", 200, "patch me  ", ""},
+		{"GET", "/api/avatars/42/64", 200, "avatar 42 64", ""},
+		// the recorder keeps the body net/http would drop
+		{"HEAD", "/api/users/42", 200, "user 42 ", ""},
+		{"GET", "/api/users/", 404, "", ""},
+		{"GET", "/api/users/42/more", 404, "", ""},
+		{"GET", "/api/nothing", 404, "", ""},
+		{"DELETE", "/api/users/me", 405, "", "GET, HEAD, OPTIONS, PATCH"},
+		{"POST", "/api/users/42", 405, "", "GET, HEAD, OPTIONS"},
+		{"GET", "/api/posts/42", 405, "", "DELETE, OPTIONS"},
+		{"OPTIONS", "/api/users/me", 204, "", "GET, HEAD, OPTIONS, PATCH"},
+		{"OPTIONS", "/api/posts/42", 204, "", "DELETE, OPTIONS"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%v %v: got status %d, want %d", tt.method, tt.path,
+				w.Code, tt.status)
+			continue
+		}
+		if tt.status == 200 && w.Body.String() != tt.body {
+			t.Errorf("%v %v: got %q, want %q", tt.method, tt.path,
+				w.Body.String(), tt.body)
+		}
+		if allow := w.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%v %v: got Allow %q, want %q", tt.method, tt.path,
+				allow, tt.allow)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// NotificationSettings are what a user wants to be pushed, and when
+type NotificationSettings struct {
+	UserID uuid.UUID `json:"-"`
+	// Classes turns notification classes on and off, missing ones are on
+	Classes map[string]bool `json:"classes"`
+	// Muted are users whose notifications are dropped
+	Muted []uuid.UUID `json:"muted"`
+	// QuietHours hold back notifications until they are over, nil for none
+	QuietHours *QuietHours `json:"quietHours"`
+}
+
+// QuietHours are a time of day in the user's time zone. They pass midnight
+// if End is before Start.
+type QuietHours struct {
+	// Start and End are given as "15:04"
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// TimeZone is a name of the IANA time zone database like "Europe/Berlin"
+	TimeZone string `json:"timeZone"`
+}
+
+const maxMutedUsers = 1000
+
+// wants tells whether the user takes notifications of class from the user
+// from
+func (ns NotificationSettings) wants(class string, from uuid.UUID) bool {
+	if on, ok := ns.Classes[class]; ok && !on {
+		return false
+	}
+	for _, id := range ns.Muted {
+		if id == from {
+			return false
+		}
+	}
+	return true
+}
+
+// quietUntil returns the end of the quiet hours now is in, if it is in any
+func (ns NotificationSettings) quietUntil(now time.Time) (time.Time, bool) {
+	q := ns.QuietHours
+	if q == nil {
+		return time.Time{}, false
+	}
+	start, err1 := time.Parse("15:04", q.Start)
+	end, err2 := time.Parse("15:04", q.End)
+	loc, err3 := time.LoadLocation(q.TimeZone)
+	// they were checked when they were saved
+	if err1 != nil || err2 != nil || err3 != nil {
+		return time.Time{}, false
+	}
+
+	t := now.In(loc)
+	at := func(days int) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day()+days, end.Hour(),
+			end.Minute(), 0, 0, loc)
+	}
+	m := t.Hour()*60 + t.Minute()
+	s := start.Hour()*60 + start.Minute()
+	e := end.Hour()*60 + end.Minute()
+	switch {
+	case s < e && s <= m && m < e:
+		return at(0), true
+	case s > e && m >= s:
+		return at(1), true
+	case s > e && m < e:
+		return at(0), true
+	}
+	return time.Time{}, false
+}
+
+// notificationSettings returns the settings of a user, who might never have
+// changed them
+func (app *App) notificationSettings(ctx context.Context,
+	uid uuid.UUID) (NotificationSettings, error) {
+
+	ns, err := app.db.GetNotificationSettings(ctx, uid)
+	if err == ErrNoSuchEntity {
+		ns, err = NotificationSettings{UserID: uid}, nil
+	}
+	if err != nil {
+		return ns, err
+	}
+	// list all classes, so clients know what there is
+	classes := map[string]bool{}
+	for name := range app.push.Classes {
+		classes[name] = true
+	}
+	for name, on := range ns.Classes {
+		classes[name] = on
+	}
+	ns.Classes = classes
+	if ns.Muted == nil {
+		ns.Muted = []uuid.UUID{}
+	}
+	return ns, nil
+}
+
+// screen checks note against the settings of the owner of s. It returns
+// whether to drop note, or else until when to hold it back.
+func (app *App) screen(ctx context.Context, s Subscription, note notification,
+	now time.Time) (drop bool, until time.Time) {
+
+	ns, err := app.notificationSettings(ctx, s.UserID)
+	if err != nil {
+		// better an unwanted notification than a lost one
+		log.Printf("could not get notification settings of %v (%v)",
+			s.UserID, err)
+		return false, time.Time{}
+	}
+	if !ns.wants(note.class, note.from) {
+		return true, time.Time{}
+	}
+	until, _ = ns.quietUntil(now)
+	return false, until
+}
+
+func (app *App) getNotificationSettings(w http.ResponseWriter,
+	req *http.Request) {
+
+	ctx := req.Context()
+
+	u, err := app.getUser(ctx)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+	ns, err := app.notificationSettings(ctx, u.ID)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get notification settings", err)
+		return
+	}
+	writeNotificationSettings(w, req, ns)
+}
+
+// putNotificationSettings replaces all notification settings of the user
+func (app *App) putNotificationSettings(w http.ResponseWriter,
+	req *http.Request) {
+
+	ctx := req.Context()
+
+	ns := NotificationSettings{}
+	err := json.NewDecoder(req.Body).Decode(&ns)
+	if err != nil {
+		writeError(w, req, http.StatusBadRequest, codeInvalidJSON,
+			"could not read json body", err)
+		return
+	}
+	for name := range ns.Classes {
+		if _, ok := app.push.Classes[name]; !ok {
+			writeFieldError(w, req, "classes",
+				fmt.Sprintf("there is no notification class %q", name))
+			return
+		}
+	}
+	if len(ns.Muted) > maxMutedUsers {
+		writeFieldError(w, req, "muted", fmt.Sprintf(
+			"can hold at most %d users", maxMutedUsers))
+		return
+	}
+	if q := ns.QuietHours; q != nil {
+		for field, t := range map[string]string{"start": q.Start, "end": q.End} {
+			if _, err := time.Parse("15:04", t); err != nil {
+				writeFieldError(w, req, "quietHours."+field,
+					"must be a time like 22:30")
+				return
+			}
+		}
+		if q.Start == q.End {
+			writeFieldError(w, req, "quietHours.end",
+				"must be different from start")
+			return
+		}
+		if _, err := time.LoadLocation(q.TimeZone); err != nil ||
+			q.TimeZone == "" {
+
+			writeFieldError(w, req, "quietHours.timeZone",
+				fmt.Sprintf("unknown time zone %q", q.TimeZone))
+			return
+		}
+	}
+
+	u, err := app.getUser(ctx)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get user", err)
+		return
+	}
+	ns.UserID = u.ID
+	err = app.db.PutNotificationSettings(ctx, ns)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not save notification settings", err)
+		return
+	}
+
+	ns, err = app.notificationSettings(ctx, u.ID)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not get notification settings", err)
+		return
+	}
+	writeNotificationSettings(w, req, ns)
+}
+
+func writeNotificationSettings(w http.ResponseWriter, req *http.Request,
+	ns NotificationSettings) {
+
+	json, err := json.Marshal(ns)
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not marshal notification settings", err)
+		return
+	}
+	w.Write(json)
+}
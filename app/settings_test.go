@@ -0,0 +1,66 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietUntil(t *testing.T) {
+	utc := func(s string) time.Time {
+		t.Helper()
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := map[string]struct {
+		quiet *QuietHours
+		now   string
+		// want is empty if now is not quiet
+		want string
+	}{
+		"none": {nil, "2026-06-15T12:00:00Z", ""},
+		"day": {&QuietHours{"09:00", "17:00", "UTC"},
+			"2026-06-15T12:00:00Z", "2026-06-15T17:00:00Z"},
+		"before day": {&QuietHours{"09:00", "17:00", "UTC"},
+			"2026-06-15T08:59:00Z", ""},
+		"end of day": {&QuietHours{"09:00", "17:00", "UTC"},
+			"2026-06-15T17:00:00Z", ""},
+		"night before midnight": {&QuietHours{"22:00", "06:00", "UTC"},
+			"2026-06-15T23:00:00Z", "2026-06-16T06:00:00Z"},
+		"night after midnight": {&QuietHours{"22:00", "06:00", "UTC"},
+			"2026-06-16T03:00:00Z", "2026-06-16T06:00:00Z"},
+		"not night": {&QuietHours{"22:00", "06:00", "UTC"},
+			"2026-06-15T12:00:00Z", ""},
+		// 23:00 on June 14th in New York
+		"other zone": {&QuietHours{"22:00", "07:00", "America/New_York"},
+			"2026-06-15T03:00:00Z", "2026-06-15T11:00:00Z"},
+		// 08:00 in New York, but in the quiet hours in UTC
+		"other zone, not night": {
+			&QuietHours{"22:00", "07:00", "America/New_York"},
+			"2026-06-15T12:00:00Z", ""},
+		// 01:30 in Berlin, at 02:00 clocks go forward an hour
+		"spring forward": {&QuietHours{"23:00", "07:00", "Europe/Berlin"},
+			"2026-03-29T00:30:00Z", "2026-03-29T05:00:00Z"},
+		// 22:00 in Berlin, at 03:00 clocks go back an hour
+		"fall back": {&QuietHours{"21:00", "07:00", "Europe/Berlin"},
+			"2026-10-24T20:00:00Z", "2026-10-25T06:00:00Z"},
+		"unknown zone": {&QuietHours{"00:00", "23:59", "Nowhere/Else"},
+			"2026-06-15T12:00:00Z", ""},
+	}
+	for name, tt := range tests {
+		ns := NotificationSettings{QuietHours: tt.quiet}
+		until, quiet := ns.quietUntil(utc(tt.now))
+		if tt.want == "" {
+			if quiet {
+				t.Errorf("%v: quiet until %v, want not quiet", name, until)
+			}
+			continue
+		}
+		if want := utc(tt.want); !quiet || !until.Equal(want) {
+			t.Errorf("%v: got %v (%v), want %v", name, until.UTC(), quiet,
+				want)
+		}
+	}
+}
@@ -0,0 +1,804 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SQLDB is a DB backed by database/sql. The statements are written for
+// SQLite, the schema is created and upgraded by the migrations in
+// sql_migrations.go when the SQLDB is opened.
+type SQLDB struct {
+	db *sql.DB
+}
+
+func NewSQLDB(ctx context.Context, db *sql.DB) (*SQLDB, error) {
+	// SQLite only has a single writer, more connections just end up in
+	// "database is locked" errors
+	db.SetMaxOpenConns(1)
+
+	err := migrate(ctx, db, migrations)
+	if err != nil {
+		return nil, fmt.Errorf("could not migrate db schema (%v)", err)
+	}
+
+	return &SQLDB{db}, nil
+}
+
+func (db *SQLDB) Close() error {
+	return db.db.Close()
+}
+
+const userColumns = `id, name, display_name, bio, avatar`
+
+func userFields(u *User) []interface{} {
+	return []interface{}{&u.ID, &u.Name, &u.DisplayName, &u.Bio, &u.Avatar}
+}
+
+func (db *SQLDB) GetUser(ctx context.Context, id uuid.UUID) (User, error) {
+	u := User{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM users WHERE id = ?`, id).Scan(userFields(&u)...)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEntity
+	}
+	return u, err
+}
+
+func (db *SQLDB) GetUsers(ctx context.Context) ([]User, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT `+userColumns+` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	us := []User{}
+	for rows.Next() {
+		u := User{}
+		err = rows.Scan(userFields(&u)...)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, u)
+	}
+	return us, rows.Err()
+}
+
+func (db *SQLDB) GetUserByName(ctx context.Context, name string) (User, error) {
+	u := User{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM users WHERE name_key = ?`,
+		NormalizeName(name)).Scan(userFields(&u)...)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEntity
+	}
+	return u, err
+}
+
+func (db *SQLDB) CreateUser(ctx context.Context, u User) error {
+	return db.putUser(ctx, u, true)
+}
+
+func (db *SQLDB) PutUser(ctx context.Context, u User) error {
+	return db.putUser(ctx, u, false)
+}
+
+func (db *SQLDB) putUser(ctx context.Context, u User, create bool) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = putUserTx(ctx, tx, u, create)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLDB) UpdateUser(ctx context.Context, id uuid.UUID,
+	f func(*User) error) (User, error) {
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	u := User{}
+	err = tx.QueryRowContext(ctx,
+		`SELECT `+userColumns+` FROM users WHERE id = ?`, id).Scan(userFields(&u)...)
+	if err == sql.ErrNoRows {
+		return User{}, ErrNoSuchEntity
+	}
+	if err != nil {
+		return User{}, err
+	}
+	err = f(&u)
+	if err != nil {
+		return User{}, err
+	}
+	u.ID = id
+	err = putUserTx(ctx, tx, u, false)
+	if err != nil {
+		return User{}, err
+	}
+	return u, tx.Commit()
+}
+
+// putUserTx checks for taken names before writing, so the unique index on
+// name_key only has to catch what slips through
+func putUserTx(ctx context.Context, tx *sql.Tx, u User, create bool) error {
+	key := NormalizeName(u.Name)
+	var owner uuid.UUID
+	err := tx.QueryRowContext(ctx,
+		`SELECT id FROM users WHERE name_key = ?`, key).Scan(&owner)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case owner != u.ID:
+		return ErrNameTaken
+	}
+
+	if create {
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO users (id, name, name_key, display_name, bio, avatar)
+			VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+			u.ID, u.Name, key, u.DisplayName, u.Bio, u.Avatar)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrEntityExists
+		}
+	} else {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO users (id, name, name_key, display_name, bio, avatar)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET name = excluded.name,
+			name_key = excluded.name_key, display_name = excluded.display_name,
+			bio = excluded.bio, avatar = excluded.avatar`,
+			u.ID, u.Name, key, u.DisplayName, u.Bio, u.Avatar)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLDB) CreateSubscription(ctx context.Context, s Subscription) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO subscriptions (endpoint, user_id, session_id, p256dh, auth)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (endpoint) DO UPDATE SET user_id = excluded.user_id,
+		session_id = excluded.session_id, p256dh = excluded.p256dh,
+		auth = excluded.auth`,
+		s.Endpoint, s.UserID, s.SessionID, s.P256dh, s.Auth)
+	return err
+}
+
+const subscriptionColumns = `user_id, session_id, endpoint, p256dh, auth`
+
+func (db *SQLDB) GetSubscription(ctx context.Context, endpoint string) (Subscription, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT `+subscriptionColumns+` FROM subscriptions
+		WHERE endpoint = ?`, endpoint)
+	if err != nil {
+		return Subscription{}, err
+	}
+	defer rows.Close()
+
+	ss, err := scanSubscriptions(rows)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if len(ss) == 0 {
+		return Subscription{}, ErrNoSuchEntity
+	}
+	return ss[0], nil
+}
+
+func (db *SQLDB) ReadSubscriptions(ctx context.Context, uid uuid.UUID) ([]Subscription, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT `+subscriptionColumns+` FROM subscriptions WHERE user_id = ?`,
+		uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSubscriptions(rows)
+}
+
+func (db *SQLDB) ReadAllSubscriptions(ctx context.Context) ([]Subscription, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT `+subscriptionColumns+` FROM subscriptions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSubscriptions(rows)
+}
+
+func scanSubscriptions(rows *sql.Rows) ([]Subscription, error) {
+	ss := []Subscription{}
+	for rows.Next() {
+		s := Subscription{}
+		err := rows.Scan(&s.UserID, &s.SessionID, &s.Endpoint, &s.P256dh,
+			&s.Auth)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	return ss, rows.Err()
+}
+
+func (db *SQLDB) DeleteSubscription(ctx context.Context, endpoint, reason string) error {
+	n, err := db.deleteSubscriptions(ctx, `endpoint = ?`, endpoint, reason)
+	if err == nil && n == 0 {
+		err = ErrNoSuchEntity
+	}
+	return err
+}
+
+// deleteSubscriptions deletes the subscriptions matching where and records
+// their removal. It returns how many there were.
+func (db *SQLDB) deleteSubscriptions(ctx context.Context, where string,
+	arg interface{}, reason string) (int64, error) {
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO subscription_removals (user_id, endpoint, reason, time)
+		SELECT user_id, endpoint, ?, ? FROM subscriptions WHERE `+where,
+		reason, Time{time.Now()}, arg)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx,
+		`DELETE FROM subscriptions WHERE `+where, arg)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+func (db *SQLDB) ReadSubscriptionRemovals(ctx context.Context, uid uuid.UUID) ([]SubscriptionRemoval, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT user_id, endpoint, reason, time FROM subscription_removals
+		WHERE user_id = ? ORDER BY time DESC, rowid DESC`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rs := []SubscriptionRemoval{}
+	for rows.Next() {
+		r := SubscriptionRemoval{}
+		err = rows.Scan(&r.UserID, &r.Endpoint, &r.Reason, &r.Time)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, rows.Err()
+}
+
+func (db *SQLDB) GetKey(ctx context.Context) (KeyPair, error) {
+	kp := KeyPair{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT pk, sk FROM keys WHERE name = 'vapid'`).Scan(&kp.PK, &kp.SK)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEntity
+	}
+	return kp, err
+}
+
+func (db *SQLDB) PutKey(ctx context.Context, kp KeyPair) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO keys (name, pk, sk) VALUES ('vapid', ?, ?)
+		ON CONFLICT (name) DO UPDATE SET pk = excluded.pk, sk = excluded.sk`,
+		kp.PK, kp.SK)
+	return err
+}
+
+func (db *SQLDB) ReadPosts(ctx context.Context, cursor string, limit int) ([]Post, string, error) {
+	// start before the newest possible post if there is no cursor
+	after := postCursor{ms: math.MaxInt64, id: uuid.Nil}
+	if cursor != "" {
+		c, err := parsePostCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = c
+	}
+
+	// one more than asked for to know if there is a next page
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT `+postColumns+` FROM posts
+		WHERE deleted = 0 AND (time < ? OR (time = ? AND id < ?))
+		ORDER BY time DESC, id DESC LIMIT ?`,
+		after.ms, after.ms, after.id.String(), limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	ps, err := scanPosts(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(ps) <= limit {
+		return ps, "", nil
+	}
+	ps = ps[:limit]
+	return ps, cursorOf(ps[limit-1]).String(), nil
+}
+
+func (db *SQLDB) ReadPostChanges(ctx context.Context, since int64, limit int) ([]Post, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT `+postColumns+` FROM posts WHERE version > ?
+		ORDER BY version LIMIT ?`, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanPosts(rows)
+}
+
+func (db *SQLDB) GetPost(ctx context.Context, id uuid.UUID) (Post, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT `+postColumns+` FROM posts WHERE id = ?`, id)
+	if err != nil {
+		return Post{}, err
+	}
+	defer rows.Close()
+
+	ps, err := scanPosts(rows)
+	if err != nil {
+		return Post{}, err
+	}
+	if len(ps) == 0 {
+		return Post{}, ErrNoSuchEntity
+	}
+	return ps[0], nil
+}
+
+func (db *SQLDB) CreatePost(ctx context.Context, p Post) (Post, error) {
+	res, err := db.db.ExecContext(ctx,
+		`INSERT INTO posts (id, user_id, user_name, text, time, edited, deleted,
+			version)
+		VALUES (?, ?, '', ?, ?, ?, ?,
+			(SELECT COALESCE(MAX(version), 0) + 1 FROM posts))
+		ON CONFLICT (id) DO NOTHING`,
+		p.ID, p.User.ID, p.Text, p.Time, p.Edited, p.Deleted)
+	if err != nil {
+		return Post{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Post{}, err
+	}
+
+	p2, err := db.GetPost(ctx, p.ID)
+	if err != nil {
+		return Post{}, err
+	}
+	if n == 0 {
+		return p2, ErrEntityExists
+	}
+	return p2, nil
+}
+
+func (db *SQLDB) PutPost(ctx context.Context, p Post) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO posts (id, user_id, user_name, text, time, edited, deleted,
+			version)
+		VALUES (?, ?, '', ?, ?, ?, ?,
+			(SELECT COALESCE(MAX(version), 0) + 1 FROM posts))
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id,
+		text = excluded.text,
+		time = excluded.time, edited = excluded.edited,
+		deleted = excluded.deleted, version = excluded.version`,
+		p.ID, p.User.ID, p.Text, p.Time, p.Edited, p.Deleted)
+	return err
+}
+
+const postColumns = `id, user_id, text, time, edited, deleted, version`
+
+func scanPosts(rows *sql.Rows) ([]Post, error) {
+	ps := []Post{}
+	for rows.Next() {
+		p := Post{}
+		var edited sql.NullInt64
+		err := rows.Scan(&p.ID, &p.User.ID, &p.Text, &p.Time, &edited,
+			&p.Deleted, &p.Version)
+		if err != nil {
+			return nil, err
+		}
+		if edited.Valid {
+			p.Edited = fromMillis(edited.Int64)
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
+
+func (db *SQLDB) CreateSession(ctx context.Context, s Session) error {
+	res, err := db.db.ExecContext(ctx,
+		`INSERT INTO sessions (id, user_id, refresh_hash, device, created,
+			last_seen, expires, revoked)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		s.ID, s.UserID, s.RefreshHash, s.Device, s.Created, s.LastSeen,
+		s.Expires, s.Revoked)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEntityExists
+	}
+	return nil
+}
+
+func (db *SQLDB) GetSession(ctx context.Context, id uuid.UUID) (Session, error) {
+	s := Session{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT id, user_id, refresh_hash, device, created, last_seen, expires,
+			revoked
+		FROM sessions WHERE id = ?`, id).Scan(&s.ID, &s.UserID,
+		&s.RefreshHash, &s.Device, &s.Created, &s.LastSeen, &s.Expires,
+		&s.Revoked)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEntity
+	}
+	return s, err
+}
+
+func (db *SQLDB) TouchSession(ctx context.Context, id uuid.UUID, lastSeen time.Time) error {
+	res, err := db.db.ExecContext(ctx,
+		`UPDATE sessions SET last_seen = ? WHERE id = ? AND NOT revoked`,
+		Time{lastSeen}, id)
+	return db.sessionUpdated(ctx, res, err, id)
+}
+
+func (db *SQLDB) RotateRefresh(ctx context.Context, id uuid.UUID, oldHash,
+	newHash string, lastSeen time.Time) error {
+
+	res, err := db.db.ExecContext(ctx,
+		`UPDATE sessions SET refresh_hash = ?, last_seen = ?
+		WHERE id = ? AND refresh_hash = ? AND NOT revoked`,
+		newHash, Time{lastSeen}, id, oldHash)
+	return db.sessionUpdated(ctx, res, err, id)
+}
+
+func (db *SQLDB) RevokeSession(ctx context.Context, id uuid.UUID) error {
+	res, err := db.db.ExecContext(ctx,
+		`UPDATE sessions SET revoked = 1 WHERE id = ?`, id)
+	return db.sessionUpdated(ctx, res, err, id)
+}
+
+// sessionUpdated tells why a conditional update of session id changed
+// nothing
+func (db *SQLDB) sessionUpdated(ctx context.Context, res sql.Result,
+	err error, id uuid.UUID) error {
+
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	var one int
+	err = db.db.QueryRowContext(ctx, `SELECT 1 FROM sessions WHERE id = ?`,
+		id).Scan(&one)
+	switch err {
+	case nil:
+		return ErrStaleSession
+	case sql.ErrNoRows:
+		return ErrNoSuchEntity
+	default:
+		return err
+	}
+}
+
+func (db *SQLDB) ReadSessions(ctx context.Context, uid uuid.UUID) ([]Session, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT id, user_id, refresh_hash, device, created, last_seen, expires,
+			revoked
+		FROM sessions WHERE user_id = ?`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ss := []Session{}
+	for rows.Next() {
+		s := Session{}
+		err = rows.Scan(&s.ID, &s.UserID, &s.RefreshHash, &s.Device,
+			&s.Created, &s.LastSeen, &s.Expires, &s.Revoked)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	return ss, rows.Err()
+}
+
+func (db *SQLDB) DeleteSessionSubscriptions(ctx context.Context, sid uuid.UUID) error {
+	_, err := db.deleteSubscriptions(ctx, `session_id = ?`, sid,
+		RemovalSessionEnded)
+	return err
+}
+
+func (db *SQLDB) GetCredential(ctx context.Context, uid uuid.UUID) (Credential, error) {
+	c := Credential{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT user_id, password_hash FROM credentials WHERE user_id = ?`,
+		uid).Scan(&c.UserID, &c.PasswordHash)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEntity
+	}
+	return c, err
+}
+
+func (db *SQLDB) PutCredential(ctx context.Context, c Credential) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO credentials (user_id, password_hash) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE
+		SET password_hash = excluded.password_hash`,
+		c.UserID, c.PasswordHash)
+	return err
+}
+
+func (db *SQLDB) GetIdentity(ctx context.Context, issuer, subject string) (Identity, error) {
+	id := Identity{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT issuer, subject, user_id FROM identities
+		WHERE issuer = ? AND subject = ?`,
+		issuer, subject).Scan(&id.Issuer, &id.Subject, &id.UserID)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEntity
+	}
+	return id, err
+}
+
+func (db *SQLDB) CreateIdentity(ctx context.Context, id Identity) error {
+	res, err := db.db.ExecContext(ctx,
+		`INSERT INTO identities (issuer, subject, user_id) VALUES (?, ?, ?)
+		ON CONFLICT (issuer, subject) DO NOTHING`,
+		id.Issuer, id.Subject, id.UserID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEntityExists
+	}
+	return nil
+}
+
+func (db *SQLDB) PutAvatar(ctx context.Context, a Avatar) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO avatars (id, size, png) VALUES (?, ?, ?)
+		ON CONFLICT (id, size) DO UPDATE SET png = excluded.png`,
+		a.ID, a.Size, a.PNG)
+	return err
+}
+
+func (db *SQLDB) GetAvatar(ctx context.Context, id uuid.UUID, size int) (Avatar, error) {
+	a := Avatar{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT id, size, png FROM avatars WHERE id = ? AND size = ?`,
+		id, size).Scan(&a.ID, &a.Size, &a.PNG)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchEntity
+	}
+	return a, err
+}
+
+func (db *SQLDB) DeleteAvatar(ctx context.Context, id uuid.UUID) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM avatars WHERE id = ?`, id)
+	return err
+}
+
+func (db *SQLDB) PutTask(ctx context.Context, t Task) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO tasks (id, kind, payload, not_before, attempts)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET kind = excluded.kind,
+		payload = excluded.payload, not_before = excluded.not_before,
+		attempts = excluded.attempts`,
+		t.ID, t.Kind, t.Payload, t.NotBefore, t.Attempts)
+	return err
+}
+
+func (db *SQLDB) ReadDueTasks(ctx context.Context, now time.Time, limit int) ([]Task, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT id, kind, payload, not_before, attempts FROM tasks
+		WHERE not_before <= ? ORDER BY not_before LIMIT ?`, Time{now}, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ts := []Task{}
+	for rows.Next() {
+		t := Task{}
+		err = rows.Scan(&t.ID, &t.Kind, &t.Payload, &t.NotBefore,
+			&t.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, rows.Err()
+}
+
+func (db *SQLDB) DeleteTask(ctx context.Context, id uuid.UUID) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM tasks WHERE id = ?`, id)
+	return err
+}
+
+func (db *SQLDB) CreateDeadLetter(ctx context.Context, d DeadLetter) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO dead_letters (id, user_id, endpoint, message, attempts,
+			status, error, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.UserID, d.Endpoint, d.Message, d.Attempts, d.Status, d.Error,
+		d.Time)
+	return err
+}
+
+func (db *SQLDB) ReadDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT id, user_id, endpoint, message, attempts, status, error, time
+		FROM dead_letters ORDER BY time DESC, rowid DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ds := []DeadLetter{}
+	for rows.Next() {
+		d := DeadLetter{}
+		err = rows.Scan(&d.ID, &d.UserID, &d.Endpoint, &d.Message,
+			&d.Attempts, &d.Status, &d.Error, &d.Time)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+func (db *SQLDB) Follow(ctx context.Context, follower, followee uuid.UUID) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO follows (follower_id, followee_id) VALUES (?, ?)
+		ON CONFLICT DO NOTHING`, follower, followee)
+	return err
+}
+
+func (db *SQLDB) Unfollow(ctx context.Context, follower, followee uuid.UUID) error {
+	_, err := db.db.ExecContext(ctx,
+		`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`,
+		follower, followee)
+	return err
+}
+
+func (db *SQLDB) ReadFollowers(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	return db.readIDs(ctx,
+		`SELECT follower_id FROM follows WHERE followee_id = ?`, uid)
+}
+
+func (db *SQLDB) ReadFollowing(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	return db.readIDs(ctx,
+		`SELECT followee_id FROM follows WHERE follower_id = ?`, uid)
+}
+
+func (db *SQLDB) readIDs(ctx context.Context, query string,
+	args ...interface{}) ([]uuid.UUID, error) {
+
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetNotificationSettings keeps classes and muted users as JSON
+func (db *SQLDB) GetNotificationSettings(ctx context.Context, uid uuid.UUID) (NotificationSettings, error) {
+	ns := NotificationSettings{UserID: uid}
+	var classes, muted []byte
+	q := QuietHours{}
+	err := db.db.QueryRowContext(ctx,
+		`SELECT classes, muted, quiet_start, quiet_end, time_zone
+		FROM notification_settings WHERE user_id = ?`, uid).Scan(&classes,
+		&muted, &q.Start, &q.End, &q.TimeZone)
+	if err == sql.ErrNoRows {
+		return ns, ErrNoSuchEntity
+	}
+	if err != nil {
+		return ns, err
+	}
+
+	err = json.Unmarshal(classes, &ns.Classes)
+	if err != nil {
+		return ns, fmt.Errorf("could not read classes (%v)", err)
+	}
+	err = json.Unmarshal(muted, &ns.Muted)
+	if err != nil {
+		return ns, fmt.Errorf("could not read muted users (%v)", err)
+	}
+	if q.Start != "" {
+		ns.QuietHours = &q
+	}
+	return ns, nil
+}
+
+func (db *SQLDB) PutNotificationSettings(ctx context.Context, ns NotificationSettings) error {
+	classes, err := json.Marshal(ns.Classes)
+	if err != nil {
+		return err
+	}
+	muted, err := json.Marshal(ns.Muted)
+	if err != nil {
+		return err
+	}
+	q := QuietHours{}
+	if ns.QuietHours != nil {
+		q = *ns.QuietHours
+	}
+
+	_, err = db.db.ExecContext(ctx,
+		`INSERT INTO notification_settings (user_id, classes, muted,
+		quiet_start, quiet_end, time_zone) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET classes = excluded.classes,
+		muted = excluded.muted, quiet_start = excluded.quiet_start,
+		quiet_end = excluded.quiet_end, time_zone = excluded.time_zone`,
+		ns.UserID, classes, muted, q.Start, q.End, q.TimeZone)
+	return err
+}
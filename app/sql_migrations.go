@@ -0,0 +1,233 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order, a database at schema version n has seen
+// the first n of them. Never edit or reorder a released migration, only
+// append new ones.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE users (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL
+	);
+	CREATE TABLE subscriptions (
+		user_id TEXT PRIMARY KEY,
+		endpoint TEXT NOT NULL,
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL
+	);
+	CREATE TABLE keys (
+		name TEXT PRIMARY KEY,
+		pk TEXT NOT NULL,
+		sk TEXT NOT NULL
+	);
+	CREATE TABLE posts (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		user_name TEXT NOT NULL,
+		text TEXT NOT NULL,
+		time INTEGER NOT NULL
+	);
+	CREATE INDEX posts_time ON posts (time, id);`,
+
+	// 2: post versions for sync and tombstones
+	`ALTER TABLE posts ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE posts ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;
+	UPDATE posts SET version = rowid;
+	CREATE UNIQUE INDEX posts_version ON posts (version);`,
+
+	// 3: post edits
+	`ALTER TABLE posts ADD COLUMN edited INTEGER;`,
+
+	// 4: login sessions
+	`CREATE TABLE sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		refresh_hash TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		expires INTEGER NOT NULL,
+		revoked INTEGER NOT NULL
+	);
+	CREATE INDEX sessions_user ON sessions (user_id);`,
+
+	// 5: passwords
+	`CREATE TABLE credentials (
+		user_id TEXT PRIMARY KEY,
+		password_hash TEXT NOT NULL
+	);
+	CREATE INDEX users_name ON users (name);`,
+
+	// 6: identity provider accounts
+	`CREATE TABLE identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	);`,
+
+	// 7: session devices and subscriptions per session
+	`ALTER TABLE sessions ADD COLUMN device TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN last_seen INTEGER NOT NULL DEFAULT 0;
+	UPDATE sessions SET last_seen = created;
+	ALTER TABLE subscriptions ADD COLUMN session_id TEXT;
+	CREATE INDEX subscriptions_session ON subscriptions (session_id);`,
+
+	// 8: unique user names. SQLite's lower() only folds ASCII, which is good
+	// enough for existing names, new keys come from NormalizeName. Earlier
+	// duplicates keep their name, later ones get the start of their ID
+	// appended.
+	`ALTER TABLE users ADD COLUMN name_key TEXT NOT NULL DEFAULT '';
+	UPDATE users SET name_key = lower(trim(name));
+	UPDATE users SET name = name || '-' || substr(id, 1, 8),
+		name_key = name_key || '-' || substr(id, 1, 8)
+	WHERE rowid NOT IN (SELECT min(rowid) FROM users GROUP BY name_key);
+	DROP INDEX users_name;
+	CREATE UNIQUE INDEX users_name_key ON users (name_key);`,
+
+	// 9: profiles, posts.user_name is no longer used
+	`ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN avatar TEXT NOT NULL DEFAULT '';
+	CREATE TABLE avatars (
+		id TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		png BLOB NOT NULL,
+		PRIMARY KEY (id, size)
+	);`,
+
+	// 10: subscriptions by endpoint, many per user
+	`CREATE TABLE subscriptions_by_endpoint (
+		endpoint TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		session_id TEXT,
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL
+	);
+	INSERT OR REPLACE INTO subscriptions_by_endpoint
+		(endpoint, user_id, session_id, p256dh, auth)
+	SELECT endpoint, user_id, session_id, p256dh, auth FROM subscriptions;
+	DROP TABLE subscriptions;
+	ALTER TABLE subscriptions_by_endpoint RENAME TO subscriptions;
+	CREATE INDEX subscriptions_user ON subscriptions (user_id);
+	CREATE INDEX subscriptions_session ON subscriptions (session_id);`,
+
+	// 11: removed subscriptions
+	`CREATE TABLE subscription_removals (
+		user_id TEXT NOT NULL,
+		endpoint TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		time INTEGER NOT NULL
+	);
+	CREATE INDEX subscription_removals_user ON subscription_removals
+		(user_id, time);`,
+
+	// 12: task queue
+	`CREATE TABLE tasks (
+		id TEXT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		payload BLOB,
+		not_before INTEGER NOT NULL
+	);
+	CREATE INDEX tasks_not_before ON tasks (not_before);`,
+
+	// 13: notifications given up on
+	`CREATE TABLE dead_letters (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		endpoint TEXT NOT NULL,
+		message BLOB,
+		attempts INTEGER NOT NULL,
+		status INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		time INTEGER NOT NULL
+	);
+	CREATE INDEX dead_letters_time ON dead_letters (time);`,
+
+	// 14: followers
+	`CREATE TABLE follows (
+		follower_id TEXT NOT NULL,
+		followee_id TEXT NOT NULL,
+		PRIMARY KEY (follower_id, followee_id)
+	);
+	CREATE INDEX follows_followee ON follows (followee_id);`,
+
+	// 15: notification settings, quiet hours are empty strings if there are
+	// none
+	`CREATE TABLE notification_settings (
+		user_id TEXT PRIMARY KEY,
+		classes TEXT NOT NULL,
+		muted TEXT NOT NULL,
+		quiet_start TEXT NOT NULL,
+		quiet_end TEXT NOT NULL,
+		time_zone TEXT NOT NULL
+	);`,
+
+	// 16: failed runs of tasks
+	`ALTER TABLE tasks ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+}
+
+func migrate(ctx context.Context, db *sql.DB, ms []string) error {
+	_, err := db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("could not create schema_version table (%v)", err)
+	}
+
+	v, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if v > len(ms) {
+		return fmt.Errorf("db schema version %d is newer than the supported "+
+			"version %d, refusing to start", v, len(ms))
+	}
+
+	for ; v < len(ms); v++ {
+		err = applyMigration(ctx, db, v+1, ms[v])
+		if err != nil {
+			return fmt.Errorf("could not apply migration %d (%v)", v+1, err)
+		}
+	}
+
+	return nil
+}
+
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var v int
+	err := db.QueryRowContext(ctx,
+		`SELECT version FROM schema_version`).Scan(&v)
+	switch err {
+	case nil:
+		return v, nil
+	case sql.ErrNoRows:
+		_, err = db.ExecContext(ctx,
+			`INSERT INTO schema_version (version) VALUES (0)`)
+		return 0, err
+	default:
+		return 0, fmt.Errorf("could not read schema version (%v)", err)
+	}
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, v int, m string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, m)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE schema_version SET version = ?`, v)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "test.db")
+
+	open := func() *sql.DB {
+		t.Helper()
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		return db
+	}
+	exec := func(db *sql.DB, query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.ExecContext(ctx, query, args...); err != nil {
+			t.Fatalf("could not exec %q (%v)", query, err)
+		}
+	}
+
+	// data from before unique names and subscriptions by endpoint
+	db := open()
+	if err := migrate(ctx, db, migrations[:7]); err != nil {
+		t.Fatal(err)
+	}
+	first := uuid.MustParse("aaaaaaaa-0000-0000-0000-000000000000")
+	second := uuid.MustParse("bbbbbbbb-0000-0000-0000-000000000000")
+	exec(db, `INSERT INTO users (id, name) VALUES (?, 'Ann'), (?, 'ann')`,
+		first, second)
+	if err := migrate(ctx, db, migrations[:9]); err != nil {
+		t.Fatal(err)
+	}
+	exec(db, `INSERT INTO subscriptions (user_id, endpoint, p256dh, auth)
+		VALUES (?, 'https://push.example.com/1', 'p', 'a')`, first)
+	db.Close()
+
+	db = open()
+	sdb, err := NewSQLDB(ctx, db)
+	if err != nil {
+		t.Fatalf("could not migrate (%v)", err)
+	}
+	assertName := func(id uuid.UUID, want string) {
+		t.Helper()
+		u, err := sdb.GetUser(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Name != want {
+			t.Errorf("got name %q, want %q", u.Name, want)
+		}
+	}
+	assertName(first, "Ann")
+	assertName(second, "ann-bbbbbbbb")
+	u, err := sdb.GetUserByName(ctx, "ANN")
+	if err != nil || u.ID != first {
+		t.Errorf("got %v (%v) for name ANN, want %v", u.ID, err, first)
+	}
+	ss, err := sdb.ReadSubscriptions(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 1 || ss[0].Endpoint != "https://push.example.com/1" {
+		t.Errorf("subscriptions were not carried over: %+v", ss)
+	}
+	sdb.Close()
+
+	// nothing is left to do
+	db = open()
+	sdb, err = NewSQLDB(ctx, db)
+	if err != nil {
+		t.Fatalf("could not reopen (%v)", err)
+	}
+	assertName(second, "ann-bbbbbbbb")
+	v, err := schemaVersion(ctx, db)
+	if err != nil || v != len(migrations) {
+		t.Errorf("got schema version %d (%v), want %d", v, err,
+			len(migrations))
+	}
+
+	// a newer version of the app has been here
+	exec(db, `UPDATE schema_version SET version = ?`, len(migrations)+1)
+	sdb.Close()
+	db = open()
+	defer db.Close()
+	_, err = NewSQLDB(ctx, db)
+	if err == nil {
+		t.Errorf("db of a newer schema version was accepted")
+	}
+}
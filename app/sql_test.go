@@ -0,0 +1,28 @@
+package app_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/maxhille/elm-pwa-example/app"
+	"github.com/maxhille/elm-pwa-example/app/dbtest"
+)
+
+func TestSQLDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) app.DB {
+		// NewSQLDB keeps a single connection, so the in-memory database
+		// lives as long as the SQLDB
+		sdb, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := app.NewSQLDB(context.Background(), sdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
@@ -0,0 +1,243 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Task is work done outside of the request that asked for it. The queue
+// delivers it by a POST of Payload to /api/tasks/{Kind}.
+type Task struct {
+	ID      uuid.UUID
+	Kind    string
+	Payload []byte
+	// NotBefore is when the task is due
+	NotBefore Time
+	// Attempts counts the failed runs of the task
+	Attempts int
+}
+
+// Tasks is a queue of tasks. Delivery is at least once, task handlers must
+// cope with running twice.
+type Tasks interface {
+	Enqueue(context.Context, Task) error
+	// Verify tells whether a request to a task handler comes from the queue
+	Verify(*http.Request) error
+}
+
+// TaskRunner is implemented by queues that run in this process. They call
+// the task handlers directly on h.
+type TaskRunner interface {
+	Start(h http.Handler)
+}
+
+const taskNotify = "notify"
+
+var errNotFromQueue = errors.New("request does not come from the task queue")
+
+// enqueue adds a task that is due now, with payload as JSON
+func (app *App) enqueue(ctx context.Context, kind string,
+	payload interface{}) error {
+
+	bs, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return app.tasks.Enqueue(ctx, Task{
+		ID:        uuid.New(),
+		Kind:      kind,
+		Payload:   bs,
+		NotBefore: Time{time.Now()},
+	})
+}
+
+// runTask is the handler the queue delivers tasks to. Any status but 2xx
+// makes the queue try again later.
+func (app *App) runTask(w http.ResponseWriter, req *http.Request) {
+	err := app.tasks.Verify(req)
+	if err != nil {
+		writeError(w, req, http.StatusForbidden, codeForbidden,
+			"tasks can only be run by the task queue", err)
+		return
+	}
+
+	ctx := req.Context()
+	switch kind := PathParam(req, "kind"); kind {
+	case taskNotify:
+		err = app.runNotifyTask(ctx, req.Body)
+	case taskPush:
+		err = app.runPushTask(ctx, req.Body)
+	default:
+		writeError(w, req, http.StatusNotFound, codeNotFound,
+			fmt.Sprintf("no task kind %q", kind), nil)
+		return
+	}
+	if err != nil {
+		writeError(w, req, http.StatusInternalServerError, codeInternal,
+			"could not run task", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LocalTasks is a queue worked off by goroutines of this process. Tasks
+// stay in the DB until they succeed, so they survive restarts.
+type LocalTasks struct {
+	db      DB
+	workers int
+	wake    chan struct{}
+	// RetryDelay is how long a task waits after its first failure, it
+	// doubles with every further one up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// MaxAttempts is how often a task is run before it is dropped
+	MaxAttempts int
+	// PollInterval is how often the DB is checked for tasks that became due
+	PollInterval time.Duration
+}
+
+func NewLocalTasks(db DB, workers int) *LocalTasks {
+	return &LocalTasks{
+		db:            db,
+		workers:       workers,
+		wake:          make(chan struct{}, 1),
+		RetryDelay:    time.Minute,
+		MaxRetryDelay: time.Hour,
+		MaxAttempts:   10,
+		PollInterval:  5 * time.Second,
+	}
+}
+
+// localTaskKey marks requests made by a LocalTasks, a context can't be
+// forged over the network
+type localTaskKey struct{}
+
+func (q *LocalTasks) Enqueue(ctx context.Context, t Task) error {
+	err := q.db.PutTask(ctx, t)
+	if err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *LocalTasks) Verify(req *http.Request) error {
+	if req.Context().Value(localTaskKey{}) == nil {
+		return errNotFromQueue
+	}
+	return nil
+}
+
+// Start runs due tasks with up to q.workers at a time until the process ends
+func (q *LocalTasks) Start(h http.Handler) {
+	go q.dispatch(h)
+}
+
+func (q *LocalTasks) dispatch(h http.Handler) {
+	ctx := context.WithValue(context.Background(), localTaskKey{}, true)
+	running := map[uuid.UUID]bool{}
+	done := make(chan uuid.UUID)
+	poll := time.NewTicker(q.PollInterval)
+	defer poll.Stop()
+
+	for {
+		if len(running) < q.workers {
+			ts, err := q.db.ReadDueTasks(ctx, time.Now(),
+				q.workers+len(running))
+			if err != nil {
+				log.Printf("could not read due tasks (%v)", err)
+			}
+			for _, t := range ts {
+				if running[t.ID] || len(running) == q.workers {
+					continue
+				}
+				running[t.ID] = true
+				go func(t Task) {
+					q.run(ctx, h, t)
+					done <- t.ID
+				}(t)
+			}
+		}
+
+		select {
+		case id := <-done:
+			delete(running, id)
+		case <-q.wake:
+		case <-poll.C:
+		}
+	}
+}
+
+// run delivers t to its handler, then drops it or schedules it again
+func (q *LocalTasks) run(ctx context.Context, h http.Handler, t Task) {
+	req, err := http.NewRequest("POST", "/api/tasks/"+t.Kind,
+		bytes.NewReader(t.Payload))
+	if err != nil {
+		log.Printf("could not create request for task %v (%v)", t.ID, err)
+		return
+	}
+	w := &statusRecorder{header: http.Header{}, status: http.StatusOK}
+	h.ServeHTTP(w, req.WithContext(ctx))
+
+	t.Attempts++
+	switch {
+	case w.status < 300:
+		err = q.db.DeleteTask(ctx, t.ID)
+	case w.status < 500 || t.Attempts >= q.MaxAttempts:
+		// a bad request stays bad
+		log.Printf("task %v (%v) failed with status %d after %d attempts, "+
+			"dropping it", t.ID, t.Kind, w.status, t.Attempts)
+		err = q.db.DeleteTask(ctx, t.ID)
+	default:
+		delay := q.retryDelay(t.Attempts)
+		log.Printf("task %v (%v) failed with status %d, retrying in %v",
+			t.ID, t.Kind, w.status, delay)
+		t.NotBefore = Time{time.Now().Add(delay)}
+		err = q.db.PutTask(ctx, t)
+	}
+	if err != nil {
+		log.Printf("could not update task %v (%v)", t.ID, err)
+	}
+}
+
+// retryDelay is how long a task waits after it failed attempts times
+func (q *LocalTasks) retryDelay(attempts int) time.Duration {
+	d := q.RetryDelay
+	for i := 1; i < attempts && d < q.MaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > q.MaxRetryDelay {
+		d = q.MaxRetryDelay
+	}
+	return d
+}
+
+// statusRecorder is the http.ResponseWriter of in-process task requests,
+// only the status is of interest
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *statusRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+}
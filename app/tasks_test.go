@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLocalTasksRetry(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+	q := NewLocalTasks(db, 1)
+	q.MaxAttempts = 3
+
+	status := http.StatusInternalServerError
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	})
+	tk := Task{ID: uuid.New(), Kind: "k", NotBefore: Time{time.Now()}}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(db.PutTask(ctx, tk))
+	due := func() []Task {
+		ts, err := db.ReadDueTasks(ctx, time.Now().Add(24*time.Hour), 10)
+		must(err)
+		return ts
+	}
+
+	for i, delay := range []time.Duration{time.Minute, 2 * time.Minute} {
+		start := time.Now()
+		q.run(ctx, h, tk)
+		ts := due()
+		if len(ts) != 1 || ts[0].Attempts != i+1 {
+			t.Fatalf("attempt %d: got tasks %+v", i+1, ts)
+		}
+		if at := ts[0].NotBefore.Sub(start); at < delay || at > delay+time.Second {
+			t.Errorf("attempt %d: retried after %v, want %v", i+1, at, delay)
+		}
+		tk = ts[0]
+	}
+	q.run(ctx, h, tk)
+	if ts := due(); len(ts) != 0 {
+		t.Errorf("task was kept after %d attempts: %+v", q.MaxAttempts, ts)
+	}
+
+	// client errors are not retried
+	status = http.StatusNotFound
+	tk = Task{ID: uuid.New(), Kind: "k", NotBefore: Time{time.Now()}}
+	must(db.PutTask(ctx, tk))
+	q.run(ctx, h, tk)
+	if ts := due(); len(ts) != 0 {
+		t.Errorf("task was kept after status %d: %+v", status, ts)
+	}
+
+	q.MaxRetryDelay = 90 * time.Second
+	if d := q.retryDelay(1000); d != q.MaxRetryDelay {
+		t.Errorf("got delay %v, want %v", d, q.MaxRetryDelay)
+	}
+}
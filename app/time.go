@@ -4,7 +4,6 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
-	"log"
 	"time"
 )
 
@@ -19,7 +18,7 @@ func (t *Time) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	t = fromMillis(ms)
+	*t = *fromMillis(ms)
 
 	return nil
 }
@@ -29,17 +28,15 @@ func (t Time) MarshalJSON() ([]byte, error) {
 }
 
 func (t Time) Value() (driver.Value, error) {
-	log.Print("Value()")
 	return t.toMillis(), nil
 }
 
-func (t *Time) Scanner(src interface{}) error {
-	log.Print("Scanner()")
+func (t *Time) Scan(src interface{}) error {
 	ms, ok := src.(int64)
 	if !ok {
 		return fmt.Errorf("expected int64, but got %v", src)
 	}
-	t = fromMillis(ms)
+	*t = *fromMillis(ms)
 	return nil
 }
 
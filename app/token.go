@@ -0,0 +1,281 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+// Session is a login of a user on one device. Its refresh token can be
+// exchanged for new access tokens until the session expires or is revoked.
+type Session struct {
+	ID          uuid.UUID `json:"id"`
+	UserID      uuid.UUID `json:"-"`
+	RefreshHash string    `json:"-"`
+	// Device is the User-Agent of the client that logged in
+	Device   string `json:"device"`
+	Created  Time   `json:"created"`
+	LastSeen Time   `json:"lastSeen"`
+	Expires  Time   `json:"expires"`
+	Revoked  bool   `json:"-"`
+}
+
+// TokenPair is what clients get on login and refresh. The access token goes
+// into the Authorization header, the refresh token to POST /api/token.
+type TokenPair struct {
+	Access  string `json:"token"`
+	Refresh string `json:"refreshToken"`
+	Expires Time   `json:"expires"`
+}
+
+// Tokens issues HMAC-SHA256 signed access tokens bound to a session, and
+// opaque refresh tokens that are rotated on every use.
+type Tokens struct {
+	secret     []byte
+	db         DB
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+func NewTokens(secret []byte, db DB) *Tokens {
+	return &Tokens{
+		secret:     secret,
+		db:         db,
+		AccessTTL:  time.Hour,
+		RefreshTTL: 30 * 24 * time.Hour,
+	}
+}
+
+type claims struct {
+	Session uuid.UUID `json:"sid"`
+	User    uuid.UUID `json:"uid"`
+	Expires int64     `json:"exp"`
+}
+
+// Issue starts a new session for u on the given device
+func (t *Tokens) Issue(ctx context.Context, u User, device string) (TokenPair, error) {
+	now := time.Now()
+	s := Session{
+		ID:       uuid.New(),
+		UserID:   u.ID,
+		Device:   device,
+		Created:  Time{now},
+		LastSeen: Time{now},
+		Expires:  Time{now.Add(t.RefreshTTL)},
+	}
+	refresh, err := t.newRefresh(&s)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	err = t.db.CreateSession(ctx, s)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("could not create session (%v)", err)
+	}
+
+	return t.pair(s, refresh)
+}
+
+// Refresh exchanges a refresh token for a new token pair. Using an old
+// refresh token again revokes the session, as it has probably been stolen.
+func (t *Tokens) Refresh(ctx context.Context, refresh string) (TokenPair, error) {
+	// tokens from before they were signed have no signature
+	parts := strings.Split(refresh, ".")
+	signed := len(parts) == 3
+	if len(parts) != 2 && !signed {
+		return TokenPair{}, ErrInvalidToken
+	}
+	if signed {
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil || !hmac.Equal(sig, t.sign(parts[0]+"."+parts[1])) {
+			return TokenPair{}, ErrInvalidToken
+		}
+	}
+	sid, err := uuid.Parse(parts[0])
+	if err != nil {
+		return TokenPair{}, ErrInvalidToken
+	}
+
+	s, err := t.db.GetSession(ctx, sid)
+	switch err {
+	case nil:
+	case ErrNoSuchEntity:
+		return TokenPair{}, ErrInvalidToken
+	default:
+		return TokenPair{}, err
+	}
+	if s.Revoked || time.Now().After(s.Expires.Time) {
+		return TokenPair{}, ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hash(refresh)),
+		[]byte(s.RefreshHash)) != 1 {
+
+		// only a token this session was given is proof of theft, anyone
+		// can make up others
+		if !signed {
+			return TokenPair{}, ErrInvalidToken
+		}
+		err = t.Revoke(ctx, s.ID)
+		if err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, ErrInvalidToken
+	}
+
+	old := s.RefreshHash
+	next, err := t.newRefresh(&s)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	s.LastSeen = Time{time.Now()}
+	err = t.db.RotateRefresh(ctx, s.ID, old, s.RefreshHash, s.LastSeen.Time)
+	switch err {
+	case nil:
+	case ErrStaleSession:
+		// revoked meanwhile, or the same token was used twice at once
+		err = t.Revoke(ctx, s.ID)
+		if err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, ErrInvalidToken
+	case ErrNoSuchEntity:
+		return TokenPair{}, ErrInvalidToken
+	default:
+		return TokenPair{}, fmt.Errorf("could not update session (%v)", err)
+	}
+
+	return t.pair(s, next)
+}
+
+// Verify checks signature and expiry of an access token and that its
+// session is still alive
+func (t *Tokens) Verify(ctx context.Context, access string) (Session, error) {
+	parts := strings.SplitN(access, ".", 2)
+	if len(parts) != 2 {
+		return Session{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, t.sign(parts[0])) {
+		return Session{}, ErrInvalidToken
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Session{}, ErrInvalidToken
+	}
+	c := claims{}
+	err = json.Unmarshal(bs, &c)
+	if err != nil {
+		return Session{}, ErrInvalidToken
+	}
+	if time.Now().After(fromMillis(c.Expires).Time) {
+		return Session{}, ErrInvalidToken
+	}
+
+	s, err := t.db.GetSession(ctx, c.Session)
+	switch err {
+	case nil:
+	case ErrNoSuchEntity:
+		return Session{}, ErrInvalidToken
+	default:
+		return Session{}, err
+	}
+	if s.Revoked || s.UserID != c.User {
+		return Session{}, ErrInvalidToken
+	}
+
+	// only note activity now and then, not on every request
+	now := time.Now()
+	if now.Sub(s.LastSeen.Time) > lastSeenPrecision {
+		s.LastSeen = Time{now}
+		err = t.db.TouchSession(ctx, s.ID, now)
+		switch err {
+		case nil:
+		case ErrStaleSession, ErrNoSuchEntity:
+			// revoked since it was read
+			return Session{}, ErrInvalidToken
+		default:
+			log.Printf("could not update last seen of session %v (%v)", s.ID,
+				err)
+		}
+	}
+
+	return s, nil
+}
+
+const lastSeenPrecision = 5 * time.Minute
+
+// Revoke ends a session, its tokens stop working right away and its push
+// subscriptions are dropped
+func (t *Tokens) Revoke(ctx context.Context, sid uuid.UUID) error {
+	err := t.db.RevokeSession(ctx, sid)
+	if err == ErrNoSuchEntity {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("could not revoke session (%v)", err)
+	}
+	err = t.db.DeleteSessionSubscriptions(ctx, sid)
+	if err != nil {
+		return fmt.Errorf("could not delete subscriptions of session (%v)",
+			err)
+	}
+	return nil
+}
+
+func (t *Tokens) pair(s Session, refresh string) (TokenPair, error) {
+	exp := Time{time.Now().Add(t.AccessTTL)}
+	bs, err := json.Marshal(claims{
+		Session: s.ID,
+		User:    s.UserID,
+		Expires: exp.toMillis(),
+	})
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(bs)
+	sig := base64.RawURLEncoding.EncodeToString(t.sign(payload))
+	return TokenPair{
+		Access:  payload + "." + sig,
+		Refresh: refresh,
+		Expires: exp,
+	}, nil
+}
+
+// newRefresh makes a new refresh token for s and stores its hash in s. The
+// token is signed, so Refresh can tell the ones it issued.
+func (t *Tokens) newRefresh(s *Session) (string, error) {
+	bs := make([]byte, 32)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return "", fmt.Errorf("could not create refresh token (%v)", err)
+	}
+	refresh := s.ID.String() + "." + base64.RawURLEncoding.EncodeToString(bs)
+	refresh += "." + base64.RawURLEncoding.EncodeToString(t.sign(refresh))
+	s.RefreshHash = hash(refresh)
+	return refresh, nil
+}
+
+func (t *Tokens) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTokensVerify(t *testing.T) {
+	ctx := context.Background()
+	tokens := NewTokens([]byte("secret"), NewMemoryDB())
+	u := User{ID: uuid.New(), Name: "ann"}
+
+	tp, err := tokens.Issue(ctx, u, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tokens.Verify(ctx, tp.Access)
+	if err != nil || s.UserID != u.ID {
+		t.Fatalf("got session %+v (%v), want one of %v", s, err, u.ID)
+	}
+
+	other, err := NewTokens([]byte("other secret"), NewMemoryDB()).
+		Issue(ctx, u, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// claims of another user under the original signature
+	parts := strings.SplitN(tp.Access, ".", 2)
+	bs, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	forged := strings.Replace(string(bs), u.ID.String(), uuid.New().String(),
+		1)
+	tests := map[string]string{
+		"empty":  "",
+		"no dot": parts[0],
+		"claims": base64.RawURLEncoding.EncodeToString([]byte(forged)) +
+			"." + parts[1],
+		"signature":    parts[0] + "." + parts[1][1:],
+		"other secret": other.Access,
+	}
+	for name, access := range tests {
+		if _, err = tokens.Verify(ctx, access); err != ErrInvalidToken {
+			t.Errorf("%v: got %v, want %v", name, err, ErrInvalidToken)
+		}
+	}
+
+	tokens.AccessTTL = -time.Second
+	tp, err = tokens.Issue(ctx, u, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tokens.Verify(ctx, tp.Access); err != ErrInvalidToken {
+		t.Errorf("got %v for an expired token, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestTokensRefresh(t *testing.T) {
+	ctx := context.Background()
+	tokens := NewTokens([]byte("secret"), NewMemoryDB())
+	u := User{ID: uuid.New(), Name: "ann"}
+
+	first, err := tokens.Issue(ctx, u, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := tokens.Refresh(ctx, first.Refresh)
+	if err != nil {
+		t.Fatalf("could not refresh (%v)", err)
+	}
+	if second.Refresh == first.Refresh {
+		t.Errorf("refresh token was not rotated")
+	}
+	if _, err = tokens.Verify(ctx, second.Access); err != nil {
+		t.Errorf("new access token does not work (%v)", err)
+	}
+
+	// made up tokens for the session don't end it
+	sid := strings.SplitN(first.Refresh, ".", 2)[0]
+	for _, refresh := range []string{sid + ".guess", sid + ".guess.sig"} {
+		if _, err = tokens.Refresh(ctx, refresh); err != ErrInvalidToken {
+			t.Errorf("got %v for %q, want %v", err, refresh, ErrInvalidToken)
+		}
+	}
+	if _, err = tokens.Verify(ctx, second.Access); err != nil {
+		t.Errorf("made up refresh tokens revoked the session (%v)", err)
+	}
+
+	third, err := tokens.Refresh(ctx, second.Refresh)
+	if err != nil {
+		t.Fatalf("could not refresh again (%v)", err)
+	}
+
+	// the reuse of an old token looks like theft and ends the session
+	if _, err = tokens.Refresh(ctx, first.Refresh); err != ErrInvalidToken {
+		t.Errorf("got %v for a reused token, want %v", err, ErrInvalidToken)
+	}
+	if _, err = tokens.Refresh(ctx, third.Refresh); err != ErrInvalidToken {
+		t.Errorf("got %v after reuse, want %v", err, ErrInvalidToken)
+	}
+	if _, err = tokens.Verify(ctx, third.Access); err != ErrInvalidToken {
+		t.Errorf("got %v for access after reuse, want %v", err,
+			ErrInvalidToken)
+	}
+}
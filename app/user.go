@@ -3,19 +3,44 @@ package app
 import (
 	"context"
 	"net/http"
+	"strings"
 
 	"github.com/google/uuid"
 )
 
 type User struct {
-	ID   uuid.UUID `json:"id" datastore:"-"`
-	Name string    `json:"name"`
+	ID          uuid.UUID `json:"id" datastore:"-"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName,omitempty"`
+	Bio         string    `json:"bio,omitempty" datastore:",noindex"`
+	// Avatar is the ID of the current avatar, its images are served at
+	// /api/avatars/{avatar}/{size}
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// NormalizeName is the form of a user name that has to be unique, so names
+// that differ only in case or surrounding space are the same
+func NormalizeName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
 }
 
 type UserService interface {
 	Current(context.Context) uuid.UUID
+	// CurrentSession is the ID of the session the request was made in
+	CurrentSession(context.Context) uuid.UUID
+	// Decorate checks the access token of the request and returns a context
+	// for Current. Invalid, expired and revoked tokens are an error.
 	Decorate(*http.Request) (context.Context, error)
-	Register(context.Context, string) (User, error)
-	Login(context.Context, string) (uuid.UUID, error)
+	// Register creates a user with a password, it fails with ErrNameTaken
+	// if the name is taken
+	Register(ctx context.Context, name, password string) (User, error)
+	// Login checks a password, it fails with ErrInvalidCredentials
+	Login(ctx context.Context, name, password string) (User, error)
 	GetUserByName(context.Context, string) (User, error)
+	// Issue starts a new session for the user on the named device
+	Issue(ctx context.Context, u User, device string) (TokenPair, error)
+	// Refresh trades a refresh token for new tokens of the same session
+	Refresh(context.Context, string) (TokenPair, error)
+	// Revoke ends the session with the given ID
+	Revoke(context.Context, uuid.UUID) error
 }
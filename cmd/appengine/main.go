@@ -9,15 +9,18 @@ import (
 
 	"github.com/google/uuid"
 
-	cloudtasks "cloud.google.com/go/cloudtasks/apiv2beta3"
 	"cloud.google.com/go/datastore"
-	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
 )
 
 func main() {
+	tasks, err := NewCloudtasks(context.Background(), os.Getenv("TASKS_QUEUE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	srv := server.New(
 		&DatastoreDB{},
-		&Cloudtasks{},
+		tasks,
 		&GoogleAuth{},
 	)
 
@@ -131,24 +134,6 @@ func (db *DatastoreDB) PutPost(ctx context.Context, p server.Post) error {
 	return err
 }
 
-type Cloudtasks struct {
-	server.Tasks
-}
-
-func (ct *Cloudtasks) Notify(ctx context.Context) error {
-	ctc, err := cloudtasks.NewClient(ctx)
-	if err != nil {
-		return fmt.Errorf("could not create cloud tasks client (%v)", err)
-	}
-
-	treq := &taskspb.CreateTaskRequest{
-		// TODO complete, was
-		// delay.Func("notify-all", notifyAll)
-	}
-	_, err = ctc.CreateTask(ctx, treq)
-	return err
-}
-
 type GoogleAuth struct {
 	server.Auth
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2beta3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/maxhille/elm-pwa-example/app"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+)
+
+// Cloudtasks is an app.Tasks queue in Google Cloud Tasks. The queue calls
+// the task handlers of this App Engine service.
+type Cloudtasks struct {
+	client *cloudtasks.Client
+	// queue is the full name, projects/P/locations/L/queues/Q
+	queue string
+}
+
+func NewCloudtasks(ctx context.Context, queue string) (*Cloudtasks, error) {
+	c, err := cloudtasks.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cloud tasks client (%v)", err)
+	}
+	return &Cloudtasks{client: c, queue: queue}, nil
+}
+
+func (ct *Cloudtasks) Enqueue(ctx context.Context, t app.Task) error {
+	schedule, err := ptypes.TimestampProto(t.NotBefore.Time)
+	if err != nil {
+		return fmt.Errorf("invalid task time (%v)", err)
+	}
+
+	_, err = ct.client.CreateTask(ctx, &taskspb.CreateTaskRequest{
+		Parent: ct.queue,
+		Task: &taskspb.Task{
+			// named tasks are only created once
+			Name:         ct.queue + "/tasks/" + t.ID.String(),
+			ScheduleTime: schedule,
+			PayloadType: &taskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &taskspb.AppEngineHttpRequest{
+					HttpMethod:  taskspb.HttpMethod_POST,
+					RelativeUri: "/api/tasks/" + t.Kind,
+					Body:        t.Payload,
+				},
+			},
+		},
+	})
+	return err
+}
+
+// Verify relies on App Engine dropping X-AppEngine-* headers from requests
+// that don't come from inside
+func (ct *Cloudtasks) Verify(req *http.Request) error {
+	if req.Header.Get("X-AppEngine-QueueName") == "" {
+		return errors.New("request has no queue name header")
+	}
+	return nil
+}
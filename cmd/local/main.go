@@ -2,30 +2,68 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/maxhille/elm-pwa-example/app"
 	"google.golang.org/api/iterator"
 )
 
+var (
+	dbFlag     = flag.String("db", "datastore", "storage backend (datastore, memory, sqlite)")
+	sqliteFlag = flag.String("sqlite", "local.db", "sqlite database file for -db=sqlite")
+	secretFlag = flag.String("token-secret", os.Getenv("TOKEN_SECRET"),
+		"secret for signing auth tokens, random if empty")
+	issuerFlag       = flag.String("oidc-issuer", "", "OpenID Connect provider to log in with instead of passwords")
+	clientFlag       = flag.String("oidc-client-id", "", "client ID at the OpenID Connect provider")
+	clientSecretFlag = flag.String("oidc-client-secret", os.Getenv("OIDC_CLIENT_SECRET"),
+		"client secret at the OpenID Connect provider")
+	redirectFlag = flag.String("oidc-redirect", "http://localhost:8080/api/oidc/callback",
+		"callback URL registered at the OpenID Connect provider")
+	pushWorkersFlag = flag.Int("push-workers", app.DefaultPushConfig.Workers,
+		"how many push notifications are sent at the same time")
+	pushTimeoutFlag = flag.Duration("push-timeout", app.DefaultPushConfig.Timeout,
+		"time limit for each request to a push service")
+	taskWorkersFlag = flag.Int("task-workers", 4, "how many queued tasks are run at the same time")
+)
+
 func main() {
-	db, err := newlocalDB()
+	flag.Parse()
+
+	db, closeDB, err := openDB(*dbFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.close()
+	defer closeDB()
 
 	// for local dev
 	http.Handle("/", LoggingHandler{http.FileServer(newPublicFileSystem())})
 
+	us, err := newUserService(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	app := app.New(
 		db,
-		newLocalUserService(db),
+		us,
 		&localHandler{},
+		app.PushConfig{
+			Workers: *pushWorkersFlag,
+			Timeout: *pushTimeoutFlag,
+		},
+		app.NewLocalTasks(db, *taskWorkersFlag),
 	)
 
 	if err := app.Run("8080"); err != nil {
@@ -33,6 +71,38 @@ func main() {
 	}
 }
 
+func newUserService(db app.DB) (app.UserService, error) {
+	if *issuerFlag == "" {
+		return newLocalUserService(db, tokenSecret()), nil
+	}
+
+	log.Printf("logging in with %v", *issuerFlag)
+	oidc, err := app.NewOIDC(context.Background(), app.OIDCConfig{
+		Issuer:       *issuerFlag,
+		ClientID:     *clientFlag,
+		ClientSecret: *clientSecretFlag,
+		RedirectURL:  *redirectFlag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return app.NewOIDCUserService(oidc, db, app.NewTokens(tokenSecret(), db)), nil
+}
+
+func tokenSecret() []byte {
+	if *secretFlag != "" {
+		return []byte(*secretFlag)
+	}
+
+	log.Printf("no token secret given, sessions end with this process")
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return secret
+}
+
 type LoggingHandler struct {
 	handler http.Handler
 }
@@ -103,19 +173,85 @@ func (lh *localHandler) ListenAndServe(port string,
 	return http.ListenAndServe(port, handler)
 }
 
+func openDB(kind string) (app.DB, func(), error) {
+	switch kind {
+	case "datastore":
+		db, err := newlocalDB("elm-pwa-example")
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, db.close, nil
+	case "memory":
+		log.Printf("using in-memory db, nothing will be persisted")
+		return app.NewMemoryDB(), func() {}, nil
+	case "sqlite":
+		log.Printf("opening sqlite db %v", *sqliteFlag)
+		sdb, err := sql.Open("sqlite3", *sqliteFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		db, err := app.NewSQLDB(context.Background(), sdb)
+		if err != nil {
+			sdb.Close()
+			return nil, nil, err
+		}
+		return db, func() { db.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown db backend %q", kind)
+	}
+}
+
 type localDB struct {
 	client *datastore.Client
 }
 
-func newlocalDB() (*localDB, error) {
+func newlocalDB(project string) (*localDB, error) {
 	log.Printf("opening db")
 	ctx := context.Background()
-	cl, err := datastore.NewClient(ctx, "elm-pwa-example")
+	cl, err := datastore.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &localDB{cl}
+	err = db.runOnce(ctx, "post-versions", db.backfillPosts)
+	if err == nil {
+		err = db.runOnce(ctx, "user-names", db.backfillUserNames)
+	}
 	if err != nil {
+		cl.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	return &localDB{cl}, nil
+// migration marks a one-time change of stored entities as done
+type migration struct {
+	Done time.Time
+}
+
+// runOnce runs f unless the migration name was done before. The datastore
+// has no schema, entities written by older versions are changed on startup
+// instead. Only one process may start at a time.
+func (db *localDB) runOnce(ctx context.Context, name string,
+	f func(context.Context) error) error {
+
+	mk := datastore.NameKey("Migration", name, nil)
+	err := db.client.Get(ctx, mk, &migration{})
+	if err == nil {
+		return nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return fmt.Errorf("could not read migration %v (%v)", name, err)
+	}
+
+	log.Printf("migrating %v", name)
+	err = f(ctx)
+	if err != nil {
+		return fmt.Errorf("could not migrate %v (%v)", name, err)
+	}
+	_, err = db.client.Put(ctx, mk, &migration{Done: time.Now()})
+	return err
 }
 
 func (db *localDB) close() {
@@ -145,110 +281,1085 @@ func (db *localDB) GetUser(ctx context.Context, id uuid.UUID) (app.User, error)
 	u := app.User{}
 	err := db.client.Get(ctx, uk, &u)
 	u.ID = id
+	if err == datastore.ErrNoSuchEntity {
+		err = app.ErrNoSuchEntity
+	}
 	return u, err
 }
 
 func (db *localDB) GetUsers(ctx context.Context) ([]app.User, error) {
-	return nil, errors.New("not implemented")
+	q := datastore.NewQuery("User")
+	us := []app.User{}
+	ks, err := db.client.GetAll(ctx, q, &us)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range us {
+		us[i].ID = uuid.MustParse(ks[i].Name)
+	}
+	return us, nil
+}
+
+// userName reserves a normalized name for a user, the datastore has no unique
+// indexes
+type userName struct {
+	UserID string
+}
+
+func nameKey(name string) *datastore.Key {
+	return datastore.NameKey("UserName", app.NormalizeName(name), nil)
+}
+
+// backfillUserNames reserves the names of users from before unique names.
+// Like in the SQL migration, the first user keeps a name and later ones with
+// the same one get the start of their ID appended.
+func (db *localDB) backfillUserNames(ctx context.Context) error {
+	us, err := db.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range us {
+		err = db.putUser(ctx, u, false)
+		if err == app.ErrNameTaken {
+			u.Name = u.Name + "-" + u.ID.String()[:8]
+			err = db.putUser(ctx, u, false)
+		}
+		if err != nil {
+			return fmt.Errorf("could not reserve name of user %v (%v)", u.ID,
+				err)
+		}
+	}
+	return nil
+}
+
+func (db *localDB) CreateUser(ctx context.Context, u app.User) error {
+	return db.putUser(ctx, u, true)
 }
 
 func (db *localDB) PutUser(ctx context.Context, u app.User) error {
+	return db.putUser(ctx, u, false)
+}
+
+func (db *localDB) putUser(ctx context.Context, u app.User, create bool) error {
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return putUserTx(tx, u, create)
+	})
+	return err
+}
+
+func (db *localDB) UpdateUser(ctx context.Context, id uuid.UUID,
+	f func(*app.User) error) (app.User, error) {
+
+	uk := datastore.NameKey("User", id.String(), nil)
+	u := app.User{}
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		u = app.User{}
+		err := tx.Get(uk, &u)
+		if err == datastore.ErrNoSuchEntity {
+			return app.ErrNoSuchEntity
+		}
+		if err != nil {
+			return err
+		}
+		err = f(&u)
+		if err != nil {
+			return err
+		}
+		u.ID = id
+		return putUserTx(tx, u, false)
+	})
+	if err != nil {
+		return app.User{}, err
+	}
+	return u, nil
+}
+
+// putUserTx reserves the name and writes the user, and frees the old name of
+// a renamed user
+func putUserTx(tx *datastore.Transaction, u app.User, create bool) error {
 	uk := datastore.NameKey("User", u.ID.String(), nil)
-	_, err := db.client.Put(ctx, uk, &u)
+	nk := nameKey(u.Name)
+	old := app.User{}
+	err := tx.Get(uk, &old)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+	case err != nil:
+		return err
+	case create:
+		return app.ErrEntityExists
+	case nameKey(old.Name).Name != nk.Name:
+		err = tx.Delete(nameKey(old.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	n := userName{}
+	err = tx.Get(nk, &n)
+	if err == nil && n.UserID != u.ID.String() {
+		return app.ErrNameTaken
+	}
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	_, err = tx.PutMulti([]*datastore.Key{uk, nk},
+		[]interface{}{&u, &userName{UserID: u.ID.String()}})
 	return err
 }
 
+// subscription is how an app.Subscription is stored, keyed by endpoint.
+// Before there could be several per user, the one subscription of a user was
+// stored below the user without a UserID.
+type subscription struct {
+	UserID    string
+	SessionID string
+	Endpoint  string
+	P256dh    string
+	Auth      string
+}
+
+func (s subscription) toApp(k *datastore.Key) app.Subscription {
+	uid := s.UserID
+	if uid == "" && k.Parent != nil {
+		uid = k.Parent.Name
+	}
+	sid, _ := uuid.Parse(s.SessionID)
+	return app.Subscription{
+		UserID:    uuid.MustParse(uid),
+		SessionID: sid,
+		Endpoint:  s.Endpoint,
+		P256dh:    s.P256dh,
+		Auth:      s.Auth,
+	}
+}
+
+func subscriptionKey(endpoint string) *datastore.Key {
+	return datastore.NameKey("Subscription", endpoint, nil)
+}
+
 func (db *localDB) CreateSubscription(ctx context.Context, s app.Subscription) error {
-	uk := datastore.NameKey("User", s.UserID.String(), nil)
-	sk := datastore.NameKey("Subscription", "default", uk)
-	_, err := db.client.Put(ctx, sk, &s)
+	_, err := db.client.Put(ctx, subscriptionKey(s.Endpoint), &subscription{
+		UserID:    s.UserID.String(),
+		SessionID: s.SessionID.String(),
+		Endpoint:  s.Endpoint,
+		P256dh:    s.P256dh,
+		Auth:      s.Auth,
+	})
 	return err
-
 }
 
-func (db *localDB) ReadSubscription(ctx context.Context, uid uuid.UUID) (s app.Subscription, err error) {
-	uk := datastore.NameKey("User", uid.String(), nil)
-	sk := datastore.NameKey("Subscription", "default", uk)
-	s.UserID = uid
-	err = db.client.Get(ctx, sk, &s)
+func (db *localDB) GetSubscription(ctx context.Context, endpoint string) (app.Subscription, error) {
+	sk := subscriptionKey(endpoint)
+	s := subscription{}
+	err := db.client.Get(ctx, sk, &s)
 	if err == datastore.ErrNoSuchEntity {
-		err = app.ErrNoSuchEntity
+		return app.Subscription{}, app.ErrNoSuchEntity
 	}
-	return
+	if err != nil {
+		return app.Subscription{}, err
+	}
+	return s.toApp(sk), nil
+}
+
+func (db *localDB) ReadSubscriptions(ctx context.Context, uid uuid.UUID) ([]app.Subscription, error) {
+	q := datastore.NewQuery("Subscription").Filter("UserID =", uid.String())
+	ss := []subscription{}
+	ks, err := db.client.GetAll(ctx, q, &ss)
+	if err != nil {
+		return nil, err
+	}
+
+	as := make([]app.Subscription, len(ss))
+	for i := range ss {
+		as[i] = ss[i].toApp(ks[i])
+	}
+	return as, nil
 }
 
 func (db *localDB) ReadAllSubscriptions(ctx context.Context) (ss []app.Subscription, err error) {
 	q := datastore.NewQuery("Subscription")
 	it := db.client.Run(ctx, q)
 	for {
-		var s app.Subscription
-		_, err2 := it.Next(&s)
+		var s subscription
+		k, err2 := it.Next(&s)
 		if err2 == iterator.Done {
 			break
 		}
 		if err2 != nil {
 			return ss, err2
 		}
-		ss = append(ss, s)
+		ss = append(ss, s.toApp(k))
 	}
 
 	return
 }
 
-func (db *localDB) ReadPosts(ctx context.Context) ([]app.Post, error) {
-	return []app.Post{}, errors.New("not implemented")
+func (db *localDB) DeleteSessionSubscriptions(ctx context.Context, sid uuid.UUID) error {
+	q := datastore.NewQuery("Subscription").Filter("SessionID =", sid.String())
+	_, err := db.deleteSubscriptions(ctx, q, app.RemovalSessionEnded)
+	return err
+}
+
+func (db *localDB) DeleteSubscription(ctx context.Context, endpoint, reason string) error {
+	// legacy subscriptions below their user are found by endpoint as well
+	q := datastore.NewQuery("Subscription").Filter("Endpoint =", endpoint)
+	n, err := db.deleteSubscriptions(ctx, q, reason)
+	if err == nil && n == 0 {
+		err = app.ErrNoSuchEntity
+	}
+	return err
+}
+
+// subscriptionRemoval is how an app.SubscriptionRemoval is stored
+type subscriptionRemoval struct {
+	UserID   string
+	Endpoint string
+	Reason   string `datastore:",noindex"`
+	Time     time.Time
+}
+
+// deleteSubscriptions deletes the subscriptions found by q and records their
+// removal. It returns how many there were.
+func (db *localDB) deleteSubscriptions(ctx context.Context, q *datastore.Query, reason string) (int, error) {
+	ss := []subscription{}
+	ks, err := db.client.GetAll(ctx, q, &ss)
+	if err != nil || len(ks) == 0 {
+		return 0, err
+	}
+
+	now := time.Now()
+	rks := make([]*datastore.Key, len(ss))
+	rs := make([]subscriptionRemoval, len(ss))
+	for i := range ss {
+		s := ss[i].toApp(ks[i])
+		rks[i] = datastore.IncompleteKey("SubscriptionRemoval", nil)
+		rs[i] = subscriptionRemoval{
+			UserID:   s.UserID.String(),
+			Endpoint: s.Endpoint,
+			Reason:   reason,
+			Time:     now,
+		}
+	}
+	_, err = db.client.PutMulti(ctx, rks, rs)
+	if err != nil {
+		return 0, err
+	}
+	return len(ks), db.client.DeleteMulti(ctx, ks)
+}
+
+func (db *localDB) ReadSubscriptionRemovals(ctx context.Context, uid uuid.UUID) ([]app.SubscriptionRemoval, error) {
+	q := datastore.NewQuery("SubscriptionRemoval").
+		Filter("UserID =", uid.String()).Order("-Time")
+	rs := []subscriptionRemoval{}
+	_, err := db.client.GetAll(ctx, q, &rs)
+	if err != nil {
+		return nil, err
+	}
+
+	as := make([]app.SubscriptionRemoval, len(rs))
+	for i, r := range rs {
+		as[i] = app.SubscriptionRemoval{
+			UserID:   uuid.MustParse(r.UserID),
+			Endpoint: r.Endpoint,
+			Reason:   r.Reason,
+			Time:     app.Time{Time: r.Time},
+		}
+	}
+	return as, nil
+}
+
+// post is how an app.Post is stored, with a plain time.Time so the
+// datastore can order by it
+type post struct {
+	UserID string
+	// UserName is no longer written, it is kept to load old posts
+	UserName string
+	Text     string
+	Time     time.Time
+	Edited   time.Time
+	Deleted  bool
+	Version  int64
+}
+
+// toApp converts p, posts of unknown authors belong to uuid.Nil
+func (p post) toApp(k *datastore.Key) (app.Post, error) {
+	id, err := uuid.Parse(k.Name)
+	if err != nil {
+		return app.Post{}, fmt.Errorf("invalid post key %q (%v)", k.Name, err)
+	}
+	uid := uuid.Nil
+	if p.UserID != "" {
+		uid, err = uuid.Parse(p.UserID)
+		if err != nil {
+			return app.Post{}, fmt.Errorf("invalid author %q of post %v (%v)",
+				p.UserID, id, err)
+		}
+	}
+
+	ap := app.Post{
+		ID:      id,
+		User:    app.User{ID: uid, Name: p.UserName},
+		Text:    p.Text,
+		Time:    app.Time{Time: p.Time},
+		Deleted: p.Deleted,
+		Version: p.Version,
+	}
+	if !p.Edited.IsZero() {
+		ap.Edited = &app.Time{Time: p.Edited}
+	}
+	return ap, nil
+}
+
+// postVersion holds the last Version given to a post. It is a single
+// entity, which the datastore lets be written about once a second, and so
+// limits the rate of post writes. Sharding it would give up the order of
+// versions that sync relies on.
+type postVersion struct {
+	Version int64
+}
+
+// backfillPosts gives posts from before sync the Version and Deleted the
+// feed and sync queries filter on. The very first posts were stored with an
+// embedded user that only held the name, they get the user of that name as
+// author if there is one.
+func (db *localDB) backfillPosts(ctx context.Context) error {
+	var pls []datastore.PropertyList
+	ks, err := db.client.GetAll(ctx, datastore.NewQuery("Post"), &pls)
+	if err != nil {
+		return err
+	}
+
+	for i, pl := range pls {
+		p, versioned := legacyPost(pl)
+		if versioned {
+			continue
+		}
+		if p.UserID == "" && p.UserName != "" {
+			q := datastore.NewQuery("User").Filter("Name =", p.UserName).
+				KeysOnly().Limit(1)
+			uks, err := db.client.GetAll(ctx, q, nil)
+			if err != nil {
+				return err
+			}
+			if len(uks) == 1 {
+				p.UserID = uks[0].Name
+			}
+		}
+		ap, err := p.toApp(ks[i])
+		if err != nil {
+			log.Printf("skipping post (%v)", err)
+			continue
+		}
+		_, err = db.putPost(ctx, ap, p.UserName, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyPost reads a post stored by any version, and tells whether it has a
+// Version already
+func legacyPost(pl datastore.PropertyList) (post, bool) {
+	p := post{}
+	versioned := false
+	for _, prop := range pl {
+		switch v := prop.Value.(type) {
+		case string:
+			switch prop.Name {
+			case "UserID":
+				p.UserID = v
+			case "UserName":
+				p.UserName = v
+			case "Text":
+				p.Text = v
+			}
+		case time.Time:
+			switch prop.Name {
+			case "Time":
+				p.Time = v
+			case "Edited":
+				p.Edited = v
+			}
+		case bool:
+			if prop.Name == "Deleted" {
+				p.Deleted = v
+			}
+		case int64:
+			if prop.Name == "Version" {
+				versioned = true
+			}
+		case *datastore.Entity:
+			// app.User and app.Time stored as they were
+			for _, ep := range v.Properties {
+				switch ev := ep.Value.(type) {
+				case string:
+					if prop.Name == "User" && ep.Name == "Name" {
+						p.UserName = ev
+					}
+				case time.Time:
+					if prop.Name == "Time" && ep.Name == "Time" {
+						p.Time = ev
+					}
+				}
+			}
+		}
+	}
+	return p, versioned
+}
+
+func (db *localDB) ReadPosts(ctx context.Context, cursor string, limit int) ([]app.Post, string, error) {
+	// one more than asked for to know if there is a next page
+	q := datastore.NewQuery("Post").Filter("Deleted =", false).
+		Order("-Time").Order("-__key__").Limit(limit + 1)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", app.ErrInvalidCursor
+		}
+		q = q.Start(c)
+	}
+
+	ps := []app.Post{}
+	var last datastore.Cursor
+	it := db.client.Run(ctx, q)
+	for {
+		var p post
+		k, err := it.Next(&p)
+		if err == iterator.Done {
+			return ps, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if len(ps) == limit {
+			// there is more, continue after the last returned post
+			return ps, last.String(), nil
+		}
+		ap, err := p.toApp(k)
+		if err != nil {
+			return nil, "", err
+		}
+		ps = append(ps, ap)
+		last, err = it.Cursor()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+func (db *localDB) ReadPostChanges(ctx context.Context, since int64, limit int) ([]app.Post, error) {
+	q := datastore.NewQuery("Post").Filter("Version >", since).
+		Order("Version").Limit(limit)
+	var dps []post
+	ks, err := db.client.GetAll(ctx, q, &dps)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := make([]app.Post, len(dps))
+	for i, p := range dps {
+		ps[i], err = p.toApp(ks[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+func (db *localDB) GetPost(ctx context.Context, id uuid.UUID) (app.Post, error) {
+	pk := datastore.NameKey("Post", id.String(), nil)
+	p := post{}
+	err := db.client.Get(ctx, pk, &p)
+	if err == datastore.ErrNoSuchEntity {
+		return app.Post{}, app.ErrNoSuchEntity
+	}
+	if err != nil {
+		return app.Post{}, err
+	}
+	return p.toApp(pk)
+}
+
+func (db *localDB) CreatePost(ctx context.Context, p app.Post) (app.Post, error) {
+	return db.putPost(ctx, p, "", true)
 }
 
 func (db *localDB) PutPost(ctx context.Context, p app.Post) error {
+	_, err := db.putPost(ctx, p, "", false)
+	return err
+}
+
+// putPost writes p with the next version. Only posts of unknown authors
+// keep a userName.
+func (db *localDB) putPost(ctx context.Context, p app.Post, userName string,
+	create bool) (app.Post, error) {
+
 	pk := datastore.NameKey("Post", p.ID.String(), nil)
-	_, err := db.client.Put(ctx, pk, &p)
+	vk := datastore.NameKey("PostVersion", "default", nil)
+	var stored app.Post
+	// the counter serializes all post writes, so versions become visible
+	// in order
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if create {
+			existing := post{}
+			err := tx.Get(pk, &existing)
+			if err == nil {
+				stored, err = existing.toApp(pk)
+				if err != nil {
+					return err
+				}
+				return app.ErrEntityExists
+			}
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+
+		v := postVersion{}
+		err := tx.Get(vk, &v)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		v.Version++
+		_, err = tx.Put(vk, &v)
+		if err != nil {
+			return err
+		}
+		dp := post{
+			UserID:   p.User.ID.String(),
+			UserName: userName,
+			Text:     p.Text,
+			Time:     p.Time.Time,
+			Deleted:  p.Deleted,
+			Version:  v.Version,
+		}
+		if p.Edited != nil {
+			dp.Edited = p.Edited.Time
+		}
+		_, err = tx.Put(pk, &dp)
+		if err != nil {
+			return err
+		}
+		stored, err = dp.toApp(pk)
+		return err
+	})
+	return stored, err
+}
+
+// session is how an app.Session is stored
+type session struct {
+	UserID      string
+	RefreshHash string
+	Device      string
+	Created     time.Time
+	LastSeen    time.Time
+	Expires     time.Time
+	Revoked     bool
+}
+
+func (db *localDB) CreateSession(ctx context.Context, s app.Session) error {
+	sk := datastore.NameKey("Session", s.ID.String(), nil)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		err := tx.Get(sk, &session{})
+		if err == nil {
+			return app.ErrEntityExists
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = tx.Put(sk, toSession(s))
+		return err
+	})
 	return err
 }
 
-func (db *localDB) GetUserByName(ctx context.Context, name string) (u app.User, err error) {
-	// TODO
-	err = errors.New("not implemented")
-	return
+func (db *localDB) GetSession(ctx context.Context, id uuid.UUID) (app.Session, error) {
+	sk := datastore.NameKey("Session", id.String(), nil)
+	s := session{}
+	err := db.client.Get(ctx, sk, &s)
+	if err == datastore.ErrNoSuchEntity {
+		return app.Session{}, app.ErrNoSuchEntity
+	}
+	if err != nil {
+		return app.Session{}, err
+	}
+	return s.toApp(sk), nil
+}
+
+func (db *localDB) TouchSession(ctx context.Context, id uuid.UUID, lastSeen time.Time) error {
+	return db.updateSession(ctx, id, func(s *session) error {
+		if s.Revoked {
+			return app.ErrStaleSession
+		}
+		s.LastSeen = lastSeen
+		return nil
+	})
+}
+
+func (db *localDB) RotateRefresh(ctx context.Context, id uuid.UUID, oldHash,
+	newHash string, lastSeen time.Time) error {
+
+	return db.updateSession(ctx, id, func(s *session) error {
+		if s.Revoked || s.RefreshHash != oldHash {
+			return app.ErrStaleSession
+		}
+		s.RefreshHash = newHash
+		s.LastSeen = lastSeen
+		return nil
+	})
+}
+
+func (db *localDB) RevokeSession(ctx context.Context, id uuid.UUID) error {
+	return db.updateSession(ctx, id, func(s *session) error {
+		s.Revoked = true
+		return nil
+	})
+}
+
+// updateSession changes a session with f in a transaction, unless f fails
+func (db *localDB) updateSession(ctx context.Context, id uuid.UUID,
+	f func(*session) error) error {
+
+	sk := datastore.NameKey("Session", id.String(), nil)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		s := session{}
+		err := tx.Get(sk, &s)
+		if err == datastore.ErrNoSuchEntity {
+			return app.ErrNoSuchEntity
+		}
+		if err != nil {
+			return err
+		}
+		err = f(&s)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Put(sk, &s)
+		return err
+	})
+	return err
+}
+
+func (db *localDB) ReadSessions(ctx context.Context, uid uuid.UUID) ([]app.Session, error) {
+	q := datastore.NewQuery("Session").Filter("UserID =", uid.String())
+	ss := []session{}
+	ks, err := db.client.GetAll(ctx, q, &ss)
+	if err != nil {
+		return nil, err
+	}
+
+	as := make([]app.Session, len(ss))
+	for i := range ss {
+		as[i] = ss[i].toApp(ks[i])
+	}
+	return as, nil
+}
+
+func toSession(s app.Session) *session {
+	return &session{
+		UserID:      s.UserID.String(),
+		RefreshHash: s.RefreshHash,
+		Device:      s.Device,
+		Created:     s.Created.Time,
+		LastSeen:    s.LastSeen.Time,
+		Expires:     s.Expires.Time,
+		Revoked:     s.Revoked,
+	}
+}
+
+func (s session) toApp(k *datastore.Key) app.Session {
+	return app.Session{
+		ID:          uuid.MustParse(k.Name),
+		UserID:      uuid.MustParse(s.UserID),
+		RefreshHash: s.RefreshHash,
+		Device:      s.Device,
+		Created:     app.Time{Time: s.Created},
+		LastSeen:    app.Time{Time: s.LastSeen},
+		Expires:     app.Time{Time: s.Expires},
+		Revoked:     s.Revoked,
+	}
+}
+
+func (db *localDB) GetUserByName(ctx context.Context, name string) (app.User, error) {
+	n := userName{}
+	err := db.client.Get(ctx, nameKey(name), &n)
+	if err == datastore.ErrNoSuchEntity {
+		return app.User{}, app.ErrNoSuchEntity
+	}
+	if err != nil {
+		return app.User{}, err
+	}
+	return db.GetUser(ctx, uuid.MustParse(n.UserID))
+}
+
+func (db *localDB) GetCredential(ctx context.Context, uid uuid.UUID) (app.Credential, error) {
+	uk := datastore.NameKey("User", uid.String(), nil)
+	ck := datastore.NameKey("Credential", "password", uk)
+	c := app.Credential{}
+	err := db.client.Get(ctx, ck, &c)
+	if err == datastore.ErrNoSuchEntity {
+		err = app.ErrNoSuchEntity
+	}
+	c.UserID = uid
+	return c, err
+}
+
+func (db *localDB) PutCredential(ctx context.Context, c app.Credential) error {
+	uk := datastore.NameKey("User", c.UserID.String(), nil)
+	ck := datastore.NameKey("Credential", "password", uk)
+	_, err := db.client.Put(ctx, ck, &c)
+	return err
+}
+
+type identity struct {
+	Issuer  string
+	Subject string
+	UserID  string
+}
+
+func identityKey(issuer, subject string) *datastore.Key {
+	return datastore.NameKey("Identity", issuer+" "+subject, nil)
+}
+
+func (db *localDB) GetIdentity(ctx context.Context, issuer, subject string) (app.Identity, error) {
+	i := identity{}
+	err := db.client.Get(ctx, identityKey(issuer, subject), &i)
+	if err == datastore.ErrNoSuchEntity {
+		return app.Identity{}, app.ErrNoSuchEntity
+	}
+	if err != nil {
+		return app.Identity{}, err
+	}
+	return app.Identity{
+		Issuer:  i.Issuer,
+		Subject: i.Subject,
+		UserID:  uuid.MustParse(i.UserID),
+	}, nil
+}
+
+func (db *localDB) CreateIdentity(ctx context.Context, id app.Identity) error {
+	ik := identityKey(id.Issuer, id.Subject)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		err := tx.Get(ik, &identity{})
+		if err == nil {
+			return app.ErrEntityExists
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = tx.Put(ik, &identity{
+			Issuer:  id.Issuer,
+			Subject: id.Subject,
+			UserID:  id.UserID.String(),
+		})
+		return err
+	})
+	return err
+}
+
+func avatarKey(id uuid.UUID) *datastore.Key {
+	return datastore.NameKey("Avatar", id.String(), nil)
+}
+
+// avatar images are stored below their avatar, keyed by size
+func (db *localDB) PutAvatar(ctx context.Context, a app.Avatar) error {
+	ik := datastore.IDKey("AvatarImage", int64(a.Size), avatarKey(a.ID))
+	_, err := db.client.Put(ctx, ik, &a)
+	return err
 }
 
-func newLocalUserService(db *localDB) app.UserService {
-	return &localUserService{db: db}
+func (db *localDB) GetAvatar(ctx context.Context, id uuid.UUID, size int) (app.Avatar, error) {
+	ik := datastore.IDKey("AvatarImage", int64(size), avatarKey(id))
+	a := app.Avatar{}
+	err := db.client.Get(ctx, ik, &a)
+	if err == datastore.ErrNoSuchEntity {
+		err = app.ErrNoSuchEntity
+	}
+	a.ID = id
+	a.Size = size
+	return a, err
+}
+
+func (db *localDB) DeleteAvatar(ctx context.Context, id uuid.UUID) error {
+	q := datastore.NewQuery("AvatarImage").Ancestor(avatarKey(id)).KeysOnly()
+	ks, err := db.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return err
+	}
+	return db.client.DeleteMulti(ctx, ks)
+}
+
+// task is how an app.Task is stored, with a plain time.Time so the
+// datastore can order by it
+type task struct {
+	Kind      string
+	Payload   []byte `datastore:",noindex"`
+	NotBefore time.Time
+	Attempts  int `datastore:",noindex"`
+}
+
+func (db *localDB) PutTask(ctx context.Context, t app.Task) error {
+	tk := datastore.NameKey("Task", t.ID.String(), nil)
+	_, err := db.client.Put(ctx, tk, &task{
+		Kind:      t.Kind,
+		Payload:   t.Payload,
+		NotBefore: t.NotBefore.Time,
+		Attempts:  t.Attempts,
+	})
+	return err
+}
+
+func (db *localDB) ReadDueTasks(ctx context.Context, now time.Time, limit int) ([]app.Task, error) {
+	q := datastore.NewQuery("Task").Filter("NotBefore <=", now).
+		Order("NotBefore").Limit(limit)
+	ts := []task{}
+	ks, err := db.client.GetAll(ctx, q, &ts)
+	if err != nil {
+		return nil, err
+	}
+
+	as := make([]app.Task, len(ts))
+	for i, t := range ts {
+		as[i] = app.Task{
+			ID:        uuid.MustParse(ks[i].Name),
+			Kind:      t.Kind,
+			Payload:   t.Payload,
+			NotBefore: app.Time{Time: t.NotBefore},
+			Attempts:  t.Attempts,
+		}
+	}
+	return as, nil
+}
+
+func (db *localDB) DeleteTask(ctx context.Context, id uuid.UUID) error {
+	return db.client.Delete(ctx, datastore.NameKey("Task", id.String(), nil))
+}
+
+// deadLetter is how an app.DeadLetter is stored
+type deadLetter struct {
+	UserID   string
+	Endpoint string
+	Message  []byte `datastore:",noindex"`
+	Attempts int
+	Status   int
+	Error    string `datastore:",noindex"`
+	Time     time.Time
+}
+
+func (db *localDB) CreateDeadLetter(ctx context.Context, d app.DeadLetter) error {
+	dk := datastore.NameKey("DeadLetter", d.ID.String(), nil)
+	_, err := db.client.Put(ctx, dk, &deadLetter{
+		UserID:   d.UserID.String(),
+		Endpoint: d.Endpoint,
+		Message:  d.Message,
+		Attempts: d.Attempts,
+		Status:   d.Status,
+		Error:    d.Error,
+		Time:     d.Time.Time,
+	})
+	return err
+}
+
+func (db *localDB) ReadDeadLetters(ctx context.Context, limit int) ([]app.DeadLetter, error) {
+	q := datastore.NewQuery("DeadLetter").Order("-Time").Limit(limit)
+	ds := []deadLetter{}
+	ks, err := db.client.GetAll(ctx, q, &ds)
+	if err != nil {
+		return nil, err
+	}
+
+	as := make([]app.DeadLetter, len(ds))
+	for i, d := range ds {
+		as[i] = app.DeadLetter{
+			ID:       uuid.MustParse(ks[i].Name),
+			UserID:   uuid.MustParse(d.UserID),
+			Endpoint: d.Endpoint,
+			Message:  d.Message,
+			Attempts: d.Attempts,
+			Status:   d.Status,
+			Error:    d.Error,
+			Time:     app.Time{Time: d.Time},
+		}
+	}
+	return as, nil
+}
+
+// follow is stored keyed by "follower followee"
+type follow struct {
+	Follower string
+	Followee string
+}
+
+func followKey(follower, followee uuid.UUID) *datastore.Key {
+	return datastore.NameKey("Follow", follower.String()+" "+
+		followee.String(), nil)
+}
+
+func (db *localDB) Follow(ctx context.Context, follower, followee uuid.UUID) error {
+	_, err := db.client.Put(ctx, followKey(follower, followee), &follow{
+		Follower: follower.String(),
+		Followee: followee.String(),
+	})
+	return err
+}
+
+func (db *localDB) Unfollow(ctx context.Context, follower, followee uuid.UUID) error {
+	return db.client.Delete(ctx, followKey(follower, followee))
+}
+
+func (db *localDB) ReadFollowers(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	return db.readFollows(ctx, "Followee", uid)
+}
+
+func (db *localDB) ReadFollowing(ctx context.Context, uid uuid.UUID) ([]uuid.UUID, error) {
+	return db.readFollows(ctx, "Follower", uid)
+}
+
+// readFollows finds the follows with uid in the given property and returns
+// the other side of each
+func (db *localDB) readFollows(ctx context.Context, property string, uid uuid.UUID) ([]uuid.UUID, error) {
+	q := datastore.NewQuery("Follow").Filter(property+" =", uid.String())
+	fs := []follow{}
+	_, err := db.client.GetAll(ctx, q, &fs)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uuid.UUID, len(fs))
+	for i, f := range fs {
+		other := f.Follower
+		if property == "Follower" {
+			other = f.Followee
+		}
+		ids[i] = uuid.MustParse(other)
+	}
+	return ids, nil
+}
+
+// notificationSettings is stored keyed by user ID. Classes that are on and
+// off are kept in separate lists, datastore has no maps.
+type notificationSettings struct {
+	On         []string
+	Off        []string
+	Muted      []string
+	QuietStart string
+	QuietEnd   string
+	TimeZone   string
+}
+
+func settingsKey(uid uuid.UUID) *datastore.Key {
+	return datastore.NameKey("NotificationSettings", uid.String(), nil)
+}
+
+func (db *localDB) GetNotificationSettings(ctx context.Context, uid uuid.UUID) (app.NotificationSettings, error) {
+	s := notificationSettings{}
+	ns := app.NotificationSettings{UserID: uid}
+	err := db.client.Get(ctx, settingsKey(uid), &s)
+	if err == datastore.ErrNoSuchEntity {
+		return ns, app.ErrNoSuchEntity
+	}
+	if err != nil {
+		return ns, err
+	}
+
+	ns.Classes = map[string]bool{}
+	for _, name := range s.On {
+		ns.Classes[name] = true
+	}
+	for _, name := range s.Off {
+		ns.Classes[name] = false
+	}
+	ns.Muted = make([]uuid.UUID, len(s.Muted))
+	for i, id := range s.Muted {
+		ns.Muted[i] = uuid.MustParse(id)
+	}
+	if s.QuietStart != "" {
+		ns.QuietHours = &app.QuietHours{
+			Start:    s.QuietStart,
+			End:      s.QuietEnd,
+			TimeZone: s.TimeZone,
+		}
+	}
+	return ns, nil
+}
+
+func (db *localDB) PutNotificationSettings(ctx context.Context, ns app.NotificationSettings) error {
+	s := notificationSettings{}
+	for name, on := range ns.Classes {
+		if on {
+			s.On = append(s.On, name)
+		} else {
+			s.Off = append(s.Off, name)
+		}
+	}
+	for _, id := range ns.Muted {
+		s.Muted = append(s.Muted, id.String())
+	}
+	if q := ns.QuietHours; q != nil {
+		s.QuietStart, s.QuietEnd, s.TimeZone = q.Start, q.End, q.TimeZone
+	}
+	_, err := db.client.Put(ctx, settingsKey(ns.UserID), &s)
+	return err
+}
+
+func newLocalUserService(db app.DB, secret []byte) app.UserService {
+	return &localUserService{
+		db:        db,
+		tokens:    app.NewTokens(secret, db),
+		passwords: app.NewPasswords(db),
+	}
 }
 
 type localUserService struct {
-	db *localDB
+	db        app.DB
+	tokens    *app.Tokens
+	passwords *app.Passwords
 }
 
 func (us *localUserService) GetUserByName(ctx context.Context, name string) (app.User, error) {
-	return app.User{}, errors.New("not implemented")
+	return us.db.GetUserByName(ctx, name)
 }
 
 func (us *localUserService) Current(ctx context.Context) uuid.UUID {
 	return ctx.Value("user").(uuid.UUID)
 }
 
+func (us *localUserService) CurrentSession(ctx context.Context) uuid.UUID {
+	return ctx.Value("session").(uuid.UUID)
+}
+
 func (us *localUserService) Decorate(req *http.Request) (context.Context, error) {
-	auth := req.Header["Authorization"]
-	if len(auth) == 0 {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
 		return req.Context(), errors.New("authorization header missing")
 	}
-	id, err := uuid.Parse(auth[0])
+	s, err := us.tokens.Verify(req.Context(), strings.TrimPrefix(auth, "Bearer "))
 	if err != nil {
 		return req.Context(), err
 	}
-	return context.WithValue(req.Context(), "user", id), nil
+	ctx := context.WithValue(req.Context(), "user", s.UserID)
+	return context.WithValue(ctx, "session", s.ID), nil
 }
 
-func (us *localUserService) Login(ctx context.Context, name string) (uuid.UUID,
-	error) {
-	u, err := us.db.GetUserByName(ctx, name)
-	return u.ID, err
+func (us *localUserService) Issue(ctx context.Context, u app.User, device string) (app.TokenPair, error) {
+	return us.tokens.Issue(ctx, u, device)
 }
 
-func (us *localUserService) Register(ctx context.Context, name string) (app.User, error) {
-	u := app.User{
-		Name: name,
-		ID:   uuid.New(),
-	}
-	return u, us.db.PutUser(ctx, u)
+func (us *localUserService) Refresh(ctx context.Context, refresh string) (app.TokenPair, error) {
+	return us.tokens.Refresh(ctx, refresh)
+}
+
+func (us *localUserService) Revoke(ctx context.Context, sid uuid.UUID) error {
+	return us.tokens.Revoke(ctx, sid)
+}
+
+func (us *localUserService) Login(ctx context.Context, name, password string) (app.User, error) {
+	return us.passwords.Login(ctx, name, password)
+}
+
+func (us *localUserService) Register(ctx context.Context, name, password string) (app.User, error) {
+	return us.passwords.Register(ctx, name, password)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"github.com/maxhille/elm-pwa-example/app"
+	"github.com/maxhille/elm-pwa-example/app/dbtest"
+)
+
+// TestLocalDB needs a running emulator with strong consistency, like
+//
+//	gcloud beta emulators datastore start --consistency=1.0
+func TestLocalDB(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	dbtest.Run(t, func(t *testing.T) app.DB {
+		return newTestDB(t)
+	})
+}
+
+func TestBackfillUserNames(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	// users from before names were reserved
+	first := uuid.MustParse("aaaaaaaa-0000-0000-0000-000000000000")
+	second := uuid.MustParse("bbbbbbbb-0000-0000-0000-000000000000")
+	for _, u := range []app.User{{ID: first, Name: "Ann"},
+		{ID: second, Name: "ann"}} {
+		k := datastore.NameKey("User", u.ID.String(), nil)
+		if _, err := db.client.Put(ctx, k, &u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.backfillUserNames(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]uuid.UUID{
+		"ANN":          first,
+		"ann-bbbbbbbb": second,
+	} {
+		u, err := db.GetUserByName(ctx, name)
+		if err != nil || u.ID != want {
+			t.Errorf("got %v (%v) for name %v, want %v", u.ID, err, name,
+				want)
+		}
+	}
+	err := db.CreateUser(ctx, app.User{ID: uuid.New(), Name: "ann"})
+	if err != app.ErrNameTaken {
+		t.Errorf("got %v for a taken name, want %v", err, app.ErrNameTaken)
+	}
+}
+
+// newTestDB opens a project of its own, so it starts out empty
+func newTestDB(t *testing.T) *localDB {
+	id := strings.ReplaceAll(uuid.New().String(), "-", "")
+	db, err := newlocalDB("test-" + id[:24])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.close)
+	return db
+}
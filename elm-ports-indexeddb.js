@@ -71,5 +71,22 @@ var ElmPortsIndexedDB = {
                 });
             };
         });
+
+        app.ports.deleteInternal.subscribe(opts => {
+            // https://developer.mozilla.org/en-US/docs/Web/API/IDBObjectStore/delete
+            var db = ElmPortsIndexedDB.dbs[opts.db];
+            var tx = db.transaction([opts.name], "readwrite");
+            var store = tx.objectStore(opts.name);
+            var req = store.delete(opts.key);
+            req.onsuccess = ev => {
+                app.ports.putResultInternal.send({
+                    store: {
+                        db: opts.db,
+                        name: opts.name
+                    },
+                    key: opts.key
+                });
+            };
+        });
     }
 };
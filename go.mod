@@ -6,8 +6,11 @@ require (
 	cloud.google.com/go v0.52.0
 	cloud.google.com/go/datastore v1.1.0
 	github.com/SherClockHolmes/webpush-go v1.1.0
+	github.com/golang/protobuf v1.3.3
 	github.com/google/uuid v1.1.1
-	golang.org/x/net v0.0.0-20200301022130-244492dfa37a
+	github.com/mattn/go-sqlite3 v1.14.0
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
 	golang.org/x/tools/gopls v0.4.3 // indirect
 	google.golang.org/api v0.17.0
 	google.golang.org/genproto v0.0.0-20200212174721-66ed5ce911ce
@@ -24,3 +24,18 @@ function init() {
 
 var app = Elm.Main.init();
 ElmPortsSWClient.bind(app);
+
+// after a login with the identity provider the server redirects here with
+// the session in the fragment, the service worker takes it over
+if (location.hash.startsWith("#login=")) {
+    var session = JSON.parse(
+        decodeURIComponent(location.hash.slice("#login=".length))
+    );
+    history.replaceState(null, "", location.pathname + location.search);
+    navigator.serviceWorker.ready.then(registration => {
+        registration.active.postMessage({
+            type: "external-login",
+            session: session
+        });
+    });
+}
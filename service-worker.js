@@ -18,17 +18,37 @@ app.ports.getVapidKey.subscribe(() => {
             app.ports.onVapidkeyResult.send(text);
         });
 });
-app.ports.sendLogin.subscribe(opts => {
-    fetch("/api/login", {
+// replies {status, body}, a status of 0 when there was no response
+function postJSON(url, payload, port) {
+    fetch(url, {
         method: "POST",
-        body: JSON.stringify(opts)
+        headers: new Headers({
+            "Content-Type": "application/json"
+        }),
+        body: JSON.stringify(payload)
     })
         .then(response => {
-            return response.json();
+            return response
+                .json()
+                .catch(() => ({}))
+                .then(json => ({ status: response.status, body: json }));
         })
-        .then(function(json) {
-            app.ports.onLoginResult.send(json);
+        .catch(e => ({ status: 0, body: { detail: String(e) } }))
+        .then(result => {
+            port.send(result);
         });
+}
+
+app.ports.sendLogin.subscribe(opts => {
+    postJSON(
+        opts.register ? "/api/register" : "/api/login",
+        { name: opts.name, password: opts.password },
+        app.ports.onLoginResult
+    );
+});
+
+app.ports.sendRefresh.subscribe(opts => {
+    postJSON("/api/token", opts, app.ports.onRefreshResult);
 });
 
 app.ports.subscribeInternal.subscribe(key => {
@@ -87,15 +107,45 @@ app.ports.uploadPost.subscribe(opts => {
     });
 });
 
-app.ports.getSubscription.subscribe(opts => {
-    fetch("/api/subscription", {
+app.ports.fetchChanges.subscribe(opts => {
+    var since = encodeURIComponent(opts.payload.since);
+    fetch("/api/posts?since=" + since, {
         headers: new Headers({
             Authorization: opts.auth
         })
-    }).then(response => {
-        var result = response.status == 204;
-        app.ports.getSubscriptionReply.send(result);
-    });
+    })
+        .then(response => {
+            return response
+                .json()
+                .catch(() => ({}))
+                .then(json => ({ status: response.status, body: json }));
+        })
+        .catch(e => ({ status: 0, body: { detail: String(e) } }))
+        .then(result => {
+            app.ports.onChangesResult.send(result);
+        });
+});
+
+app.ports.getSubscription.subscribe(opts => {
+    // the server knows many devices per user, ask for this one
+    registration.pushManager
+        .getSubscription()
+        .then(subscription => {
+            if (!subscription) {
+                return false;
+            }
+            var endpoint = encodeURIComponent(subscription.endpoint);
+            return fetch("/api/subscription?endpoint=" + endpoint, {
+                headers: new Headers({
+                    Authorization: opts.auth
+                })
+            }).then(response => {
+                return response.status == 204;
+            });
+        })
+        .then(result => {
+            app.ports.getSubscriptionReply.send(result);
+        });
 });
 
 self.navigator.permissions.query({ name: "notifications" }).then(ps => {
@@ -141,22 +191,55 @@ self.addEventListener("fetch", function(event) {
 });
 
 self.addEventListener("sync", event => {
-    app.ports.onSync.send();
+    app.ports.onSync.send(JSON.stringify({ type: "sync" }));
 });
 
 self.addEventListener("push", function(event) {
-    console.log("[Service Worker] Push Received.");
-
-    var syncAndNotify = sync().then(notify());
-    event.waitUntil(syncAndNotify);
+    // {type: "post", class, post, truncated, previous, token} or
+    // {type: "sync", class}
+    var msg = { type: "sync" };
+    try {
+        msg = event.data.json();
+    } catch (e) {
+        console.log("[Service Worker] Push without a message.");
+    }
+    app.ports.onSync.send(JSON.stringify(msg));
+    event.waitUntil(notify(msg));
 });
 
-function notify() {
-    const title = "Push Codelab";
-    const options = {
-        body: "Yay it works."
-    };
-    self.registration.showNotification(title, options);
+function notify(msg) {
+    // edits and deletions only update what is shown already
+    var changed = msg.class == "post-changed";
+    if (msg.type != "post") {
+        if (changed) {
+            return Promise.resolve();
+        }
+        return self.registration.showNotification("New posts", {
+            tag: "sync"
+        });
+    }
+
+    var post = msg.post;
+    var shown = self.registration.getNotifications({ tag: post.id });
+    if (post.deleted) {
+        return shown.then(ns => ns.forEach(n => n.close()));
+    }
+    var name = post.user.displayName || post.user.name;
+    var title =
+        msg.class == "mention"
+            ? (name || "Someone") + " mentioned you"
+            : name || "New post";
+    // a later push about the same post replaces the notification
+    var show = () =>
+        self.registration.showNotification(title, {
+            body: msg.truncated ? post.text + "…" : post.text,
+            tag: post.id,
+            timestamp: post.time
+        });
+    if (changed) {
+        return shown.then(ns => (ns.length > 0 ? show() : undefined));
+    }
+    return show();
 }
 
 self.addEventListener("message", event => {